@@ -3,39 +3,146 @@ package hlfhr_lib
 // v1.2.3 not use [http.Response]
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
-// Using for interface [http.ResponseWriter], [io.StringWriter] and [io.ByteWriter].
+// Using for interface [http.ResponseWriter], [http.Flusher], [http.Hijacker],
+// [io.StringWriter] and [io.ByteWriter].
+//
+// The response created by [NewResponse] buffers the whole body,
+// [Response.FlushError] writes the complete response with the
+// Content-Length header.
+//
+// The response created by [NewResponseWithOptions] buffers the body too.
+// After the first flush, or the buffer is full, the header is written and
+// the body is streamed with chunked encoding, unless the handler set a
+// Content-Length header. [Response.Finish] must be called after the handler
+// returned. The body is not written for HEAD requests, 1xx, 204 and 304 responses.
 type Response struct {
-	conn         net.Conn
-	status       int
-	header       http.Header
-	lockedHeader http.Header
-	body         []byte
-	flushErr     error
-	close        bool
-	flushed      bool
+	conn          net.Conn
+	br            *bufio.Reader
+	req           *http.Request
+	status        int
+	header        http.Header
+	lockedHeader  http.Header
+	body          []byte
+	flushErr      error
+	close         bool
+	stream        bool
+	flushed       bool
+	finished      bool
+	hijacked      bool
+	chunked       bool
+	discard       bool
+	contentLength int64
+	written       int64
+
+	expectContinue bool
+	continueSent   bool
 }
 
+// Max size of the buffered body of streaming responses.
+const bufferSize = 4 << 10
+
+var errShortContentLength = errors.New("hlfhr: wrote less than the declared Content-Length")
+
+// NewResponse returns a response buffering the whole body,
+// [Response.FlushError] writes it with the Content-Length header.
 func NewResponse(c net.Conn, status int, closeConnection bool) *Response {
+	return newResponse(c, status, closeConnection)
+}
+
+// Options for [NewResponseWithOptions].
+type ResponseOptions struct {
+	// Reader of the connection holding the bytes already read,
+	// using for [Response.Hijack].
+	// If nil, a new reader of the connection is used.
+	Reader *bufio.Reader
+
+	// The request to respond. If it expects "100-continue",
+	// Request.Body is replaced to send "100 Continue" on the first read.
+	// If nil, it's treated as an HTTP/1.1 GET request.
+	Request *http.Request
+}
+
+// NewResponseWithOptions returns a streaming response,
+// [Response.Finish] must be called after the handler returned.
+func NewResponseWithOptions(c net.Conn, status int, closeConnection bool, opts ResponseOptions) *Response {
+	r := newResponse(c, status, closeConnection)
+	r.stream = true
+	r.br = opts.Reader
+	r.req = opts.Request
+	req := r.req
+	if req != nil && req.Body != nil && req.Body != http.NoBody && req.ProtoAtLeast(1, 1) &&
+		strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+		r.expectContinue = true
+		req.Body = &expectContinueReader{r: r, body: req.Body}
+	}
+	return r
+}
+
+func newResponse(c net.Conn, status int, closeConnection bool) *Response {
 	return &Response{
 		conn:   c,
 		status: status,
 		header: http.Header{
 			"Date": []string{time.Now().UTC().Format(http.TimeFormat)},
 		},
-		lockedHeader: nil,
-		body:         []byte{},
-		flushErr:     nil,
-		close:        closeConnection,
-		flushed:      false,
+		lockedHeader:  nil,
+		body:          []byte{},
+		flushErr:      nil,
+		close:         closeConnection,
+		flushed:       false,
+		finished:      false,
+		hijacked:      false,
+		chunked:       false,
+		discard:       false,
+		contentLength: -1,
+		written:       0,
+	}
+}
+
+// Sends "100 Continue" on the first read.
+type expectContinueReader struct {
+	r    *Response
+	body io.ReadCloser
+}
+
+func (ecr *expectContinueReader) Read(p []byte) (int, error) {
+	r := ecr.r
+	if !r.continueSent && !r.flushed && r.flushErr == nil && !r.hijacked {
+		r.continueSent = true
+		if r.write([]byte("HTTP/1.1 100 Continue\r\n\r\n")) != nil {
+			return 0, r.flushErr
+		}
+	}
+	return ecr.body.Read(p)
+}
+
+func (ecr *expectContinueReader) Close() error {
+	return ecr.body.Close()
+}
+
+// Reports whether the status allows a body.
+func bodyAllowedForStatus(status int) bool {
+	switch {
+	case status >= 100 && status <= 199:
+		return false
+	case status == 204:
+		return false
+	case status == 304:
+		return false
 	}
+	return true
 }
 
 func (r *Response) Header() http.Header {
@@ -43,7 +150,14 @@ func (r *Response) Header() http.Header {
 }
 
 // Set status code and lock header, if header does not locked.
+//
+// Informational status codes (1xx) except 101 are written immediately
+// with the current header, and the header is not locked.
 func (r *Response) WriteHeader(statusCode int) {
+	if statusCode >= 100 && statusCode <= 199 && statusCode != 101 {
+		r.writeInformational(statusCode)
+		return
+	}
 	if r.lockedHeader == nil {
 		r.status = statusCode
 		r.lockedHeader = r.header.Clone()
@@ -56,26 +170,104 @@ func (r *Response) lockHeader() {
 	}
 }
 
-func (r *Response) Write(b []byte) (int, error) {
+func (r *Response) writeInformational(statusCode int) {
+	if r.lockedHeader != nil || r.flushErr != nil || r.hijacked {
+		return
+	}
+	if r.req != nil && !r.req.ProtoAtLeast(1, 1) {
+		// HTTP/1.0 does not support it.
+		return
+	}
+	if statusCode == 100 {
+		if r.continueSent {
+			return
+		}
+		r.continueSent = true
+	}
+	buf := bytes.NewBufferString(fmt.Sprint("HTTP/1.1 ", statusCode, " ", http.StatusText(statusCode), "\r\n"))
+	r.header.Write(buf)
+	buf.WriteString("\r\n")
+	r.write(buf.Bytes())
+}
+
+func (r *Response) beforeWrite(n int) error {
+	if r.hijacked {
+		return http.ErrHijacked
+	}
+	if r.flushErr != nil {
+		return r.flushErr
+	}
+	if r.finished {
+		return http.ErrBodyNotAllowed
+	}
 	r.lockHeader()
-	if len(b) != 0 {
-		r.body = append(r.body, b...)
+	if !bodyAllowedForStatus(r.status) {
+		return http.ErrBodyNotAllowed
+	}
+	if r.flushed && !r.discard && r.contentLength >= 0 && r.written+int64(len(r.body)+n) > r.contentLength {
+		return http.ErrContentLength
+	}
+	return nil
+}
+
+func (r *Response) afterWrite() error {
+	if r.stream && len(r.body) >= bufferSize {
+		return r.FlushError()
 	}
-	return len(b), nil
+	return nil
+}
+
+func (r *Response) Write(b []byte) (int, error) {
+	if err := r.beforeWrite(len(b)); err != nil {
+		return 0, err
+	}
+	r.body = append(r.body, b...)
+	return len(b), r.afterWrite()
 }
 
 func (r *Response) WriteString(s string) (int, error) {
-	r.lockHeader()
-	if len(s) != 0 {
-		r.body = append(r.body, s...)
+	if err := r.beforeWrite(len(s)); err != nil {
+		return 0, err
 	}
-	return len(s), nil
+	r.body = append(r.body, s...)
+	return len(s), r.afterWrite()
 }
 
 func (r *Response) WriteByte(c byte) error {
-	r.lockHeader()
+	if err := r.beforeWrite(1); err != nil {
+		return err
+	}
 	r.body = append(r.body, c)
-	return nil
+	return r.afterWrite()
+}
+
+// Hijack lets the caller take over the connection.
+// The unflushed response will be discarded.
+// After a call to Hijack, the connection will not be closed by hlfhr.
+//
+// The read and write deadlines of the connection are cleared, like [http.Server].
+func (r *Response) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if r.hijacked {
+		return nil, nil, http.ErrHijacked
+	}
+	r.hijacked = true
+	r.conn.SetDeadline(time.Time{})
+	br := r.br
+	if br == nil {
+		br = bufio.NewReader(r.conn)
+	}
+	return r.conn, bufio.NewReadWriter(br, bufio.NewWriter(r.conn)), nil
+}
+
+// Reports whether [Response.Hijack] was called.
+func (r *Response) Hijacked() bool {
+	return r.hijacked
+}
+
+// Returns the status code written by [Response.WriteHeader],
+// or the default status passed to [NewResponse] or [NewResponseWithOptions].
+func (r *Response) Status() int {
+	return r.status
 }
 
 func (r *Response) SetDeadline(t time.Time) error {
@@ -90,47 +282,222 @@ func (r *Response) SetWriteDeadline(t time.Time) error {
 	return r.conn.SetWriteDeadline(t)
 }
 
+// Sets whether to add the "Connection: close" header, if not flushed.
+func (r *Response) SetCloseConnection(closeConnection bool) {
+	if !r.flushed {
+		r.close = closeConnection
+	}
+}
+
+// Reports whether the connection should be closed after the response.
+//
+// If the request expects "100-continue" but it was not sent,
+// the client may not send the body, so it reports true.
+func (r *Response) CloseConnection() bool {
+	if r.close || (r.expectContinue && !r.continueSent) {
+		return true
+	}
+	h := r.lockedHeader
+	if h == nil {
+		h = r.header
+	}
+	for _, v := range h["Connection"] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), "close") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // Flush flushes buffered data to the client.
 func (r *Response) Flush() {
 	r.FlushError()
 }
 
+// FlushError writes the header if not written, then the buffered body.
+//
+// If the response is created by [NewResponse],
+// it writes the complete response like [Response.Finish].
 func (r *Response) FlushError() error {
-	if r.flushed {
+	if !r.stream {
+		return r.Finish()
+	}
+	if r.hijacked {
+		return http.ErrHijacked
+	}
+	if r.flushErr != nil {
+		return r.flushErr
+	}
+	if !r.flushed {
+		if r.writeHeader(false) != nil {
+			return r.flushErr
+		}
+	}
+	return r.writeBody()
+}
+
+// Finish writes the buffered response and ends the body,
+// it must be called after the handler returned
+// if the response is created by [NewResponseWithOptions].
+//
+// If the response is not flushed before, the Content-Length header
+// is set to the length of the body.
+func (r *Response) Finish() error {
+	if r.hijacked {
+		return http.ErrHijacked
+	}
+	if r.finished || r.flushErr != nil {
+		return r.flushErr
+	}
+	r.finished = true
+	if !r.flushed {
+		if r.writeHeader(true) != nil {
+			return r.flushErr
+		}
+	}
+	if r.writeBody() != nil {
+		return r.flushErr
+	}
+
+	if !r.chunked {
+		if r.contentLength >= 0 && r.written != r.contentLength {
+			r.close = true
+			r.flushErr = errShortContentLength
+		}
 		return r.flushErr
 	}
+
+	// last chunk and trailer
+	buf := bytes.NewBufferString("0\r\n")
+	r.trailer().Write(buf)
+	buf.WriteString("\r\n")
+	r.write(buf.Bytes())
+	return r.flushErr
+}
+
+// Declared by the "Trailer" header, or prefixed with [http.TrailerPrefix].
+func (r *Response) trailer() http.Header {
+	trailer := http.Header{}
+	for _, v := range r.lockedHeader["Trailer"] {
+		for _, k := range strings.Split(v, ",") {
+			k = http.CanonicalHeaderKey(strings.TrimSpace(k))
+			if vv, ok := r.header[k]; ok {
+				trailer[k] = vv
+			}
+		}
+	}
+	for k, vv := range r.header {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			trailer[http.CanonicalHeaderKey(k[len(http.TrailerPrefix):])] = vv
+		}
+	}
+	return trailer
+}
+
+// Writes the status line and the header.
+// If final, the whole body is buffered.
+func (r *Response) writeHeader(final bool) error {
 	r.flushed = true
 	r.lockHeader()
+	h := r.lockedHeader
 
-	// status
-	_, r.flushErr = fmt.Fprint(r.conn, "HTTP/1.1 ", r.status, " ", http.StatusText(r.status), "\r\n")
-	if r.flushErr != nil {
-		return r.flushErr
+	for k := range h {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			delete(h, k)
+		}
 	}
+	delete(h, "Transfer-Encoding")
 
-	// header
-	if r.close {
-		r.lockedHeader["Connection"] = []string{"close"}
+	hasTrailer := len(h["Trailer"]) != 0
+	declared, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	if err != nil || declared < 0 {
+		delete(h, "Content-Length")
+		declared = -1
 	}
-	r.lockedHeader["Content-Length"] = []string{strconv.Itoa(len(r.body))}
 
-	r.flushErr = r.lockedHeader.Write(r.conn)
-	if r.flushErr != nil {
-		return r.flushErr
+	switch {
+	case !bodyAllowedForStatus(r.status):
+		// 1xx, 204 and 304
+		r.discard = true
+		if r.status != 304 {
+			delete(h, "Content-Length")
+		}
+		delete(h, "Trailer")
+	case r.req != nil && r.req.Method == "HEAD":
+		// Keep the Content-Length set by the handler.
+		r.discard = true
+		if declared < 0 && final && len(r.body) != 0 {
+			h["Content-Length"] = []string{strconv.Itoa(len(r.body))}
+		}
+		delete(h, "Trailer")
+	case final && !hasTrailer:
+		r.contentLength = int64(len(r.body))
+		h["Content-Length"] = []string{strconv.FormatInt(r.contentLength, 10)}
+	case declared >= 0 && !hasTrailer:
+		r.contentLength = declared
+	case r.req == nil || r.req.ProtoAtLeast(1, 1):
+		r.chunked = true
+		delete(h, "Content-Length")
+		h["Transfer-Encoding"] = []string{"chunked"}
+	default:
+		// HTTP/1.0 does not support chunked encoding,
+		// the body ends when the connection closed.
+		delete(h, "Content-Length")
+		r.close = true
 	}
-	_, r.flushErr = io.WriteString(r.conn, "\r\n")
-	if r.flushErr != nil {
-		return r.flushErr
+	if r.expectContinue && !r.continueSent {
+		r.close = true
+	}
+	if r.close {
+		h["Connection"] = []string{"close"}
 	}
 
-	// body
+	// status
+	buf := bytes.NewBufferString(fmt.Sprint("HTTP/1.1 ", r.status, " ", http.StatusText(r.status), "\r\n"))
+
+	// header
+	h.Write(buf)
+	buf.WriteString("\r\n")
+
+	return r.write(buf.Bytes())
+}
+
+// Writes the buffered body.
+func (r *Response) writeBody() error {
 	if len(r.body) == 0 {
 		return nil
 	}
-	var n int
-	n, r.flushErr = r.conn.Write(r.body)
-	if r.flushErr == nil && n != len(r.body) {
-		r.flushErr = io.ErrShortWrite
+	if r.discard {
+		r.body = r.body[:0]
+		return nil
 	}
+	if r.contentLength >= 0 && r.written+int64(len(r.body)) > r.contentLength {
+		r.flushErr = http.ErrContentLength
+		return r.flushErr
+	}
+	n := int64(len(r.body))
+	if r.chunked {
+		buf := make([]byte, 0, len(r.body)+20)
+		buf = strconv.AppendInt(buf, n, 16)
+		buf = append(buf, "\r\n"...)
+		buf = append(buf, r.body...)
+		buf = append(buf, "\r\n"...)
+		r.write(buf)
+	} else {
+		r.write(r.body)
+	}
+	r.written += n
+	r.body = r.body[:0]
 	return r.flushErr
 }
+
+func (r *Response) write(b []byte) error {
+	n, err := r.conn.Write(b)
+	if err == nil && n != len(b) {
+		err = io.ErrShortWrite
+	}
+	r.flushErr = err
+	return err
+}
@@ -0,0 +1,91 @@
+package hlfhr
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Path prefix of ACME HTTP-01 challenge requests.
+const ACMEChallengePath = "/.well-known/acme-challenge/"
+
+// ACMEChallengeProvider provides the key authorizations of
+// ACME HTTP-01 challenges, such as from Let's Encrypt.
+type ACMEChallengeProvider interface {
+	// KeyAuthorization returns the key authorization for the token.
+	// If the token is unknown, it returns an error and the request gets 404.
+	KeyAuthorization(token string) (string, error)
+}
+
+// ACMEChallengeFunc is an adapter to allow the use of ordinary functions as [ACMEChallengeProvider].
+type ACMEChallengeFunc func(token string) (string, error)
+
+func (f ACMEChallengeFunc) KeyAuthorization(token string) (string, error) {
+	return f(token)
+}
+
+// ACMEChallengeMap maps tokens to key authorizations.
+//
+// It's not safe for concurrent modification while serving.
+type ACMEChallengeMap map[string]string
+
+func (m ACMEChallengeMap) KeyAuthorization(token string) (string, error) {
+	if v, ok := m[token]; ok {
+		return v, nil
+	}
+	return "", errACMETokenNotFound
+}
+
+var errACMETokenNotFound = errors.New("hlfhr: ACME token not found")
+
+// Answers the ACME HTTP-01 challenge, reports whether the request is handled.
+func (s *Server) serveACMEChallenge(w http.ResponseWriter, r *http.Request) bool {
+	if !strings.HasPrefix(r.URL.Path, ACMEChallengePath) {
+		return false
+	}
+	if s.ACMEChallenge != nil {
+		token := r.URL.Path[len(ACMEChallengePath):]
+		if token != "" && strings.IndexByte(token, '/') == -1 {
+			if keyAuth, err := s.ACMEChallenge.KeyAuthorization(token); err == nil {
+				w.Header().Set("Content-Type", "text/plain")
+				w.WriteHeader(200)
+				w.Write([]byte(keyAuth))
+				return true
+			}
+		}
+	}
+	if s.ACMEHTTPHandler != nil {
+		s.ACMEHTTPHandler(http.NotFoundHandler()).ServeHTTP(&acmeResponseWriter{ResponseWriter: w}, r)
+		return true
+	}
+	if s.CertManager != nil {
+		s.certManagerHTTPHandler().ServeHTTP(&acmeResponseWriter{ResponseWriter: w}, r)
+		return true
+	}
+	if s.ACMEChallenge != nil {
+		http.NotFound(w, r)
+		return true
+	}
+	return false
+}
+
+// Defaults the status to 200 like [http.ResponseWriter],
+// the status of the plain HTTP response defaults to 400.
+type acmeResponseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *acmeResponseWriter) WriteHeader(statusCode int) {
+	if statusCode >= 200 {
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *acmeResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(200)
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,62 @@
+package hlfhr
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	hlfhr_utils "github.com/bddjr/hlfhr/utils"
+)
+
+// Reports whether the Host header matches [Server.AllowedHosts].
+func (s *Server) hostAllowed(host string) bool {
+	if len(s.AllowedHosts) == 0 {
+		return true
+	}
+	hostname, _, err := hlfhr_utils.SplitHost(host)
+	if err != nil {
+		return false
+	}
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	ip := net.ParseIP(hostname)
+	for _, allowed := range s.AllowedHosts {
+		if ip != nil {
+			if allowedIP := net.ParseIP(strings.Trim(allowed, "[]")); allowedIP != nil && allowedIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		allowed = strings.ToLower(allowed)
+		if strings.HasPrefix(allowed, "*.") {
+			if strings.HasSuffix(hostname, allowed[1:]) {
+				return true
+			}
+		} else if hostname == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// Responds UnknownHostCode if the Host header is not allowed,
+// reports whether the request is handled.
+func (s *Server) rejectUnknownHost(w http.ResponseWriter, r *http.Request) bool {
+	if s.hostAllowed(r.Host) {
+		return false
+	}
+	s.count(func(st *Stats) { st.UnknownHosts++ })
+	s.logEvent(&Event{
+		Kind:       EventUnknownHost,
+		RemoteAddr: r.RemoteAddr,
+		Message:    fmt.Sprintf("hlfhr: Unknown host %q from %s", r.Host, r.RemoteAddr),
+	})
+	code := s.UnknownHostCode
+	if code == 0 {
+		code = http.StatusMisdirectedRequest
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write([]byte(http.StatusText(code)))
+	return true
+}
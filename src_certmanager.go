@@ -0,0 +1,63 @@
+package hlfhr
+
+import (
+	"crypto/tls"
+	"net/http"
+)
+
+// ALPN protocol of ACME TLS-ALPN-01 challenges.
+const acmeTLS1Protocol = "acme-tls/1"
+
+// CertManager obtains and renews certificates automatically, such as
+// [autocert.Manager] with a DirectoryURL of Let's Encrypt or a local ACME server.
+//
+// [autocert.Manager]: https://pkg.go.dev/golang.org/x/crypto/acme/autocert#Manager
+type CertManager interface {
+	// Returns the certificate for the TLS handshake,
+	// obtaining or renewing it if needed.
+	GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+
+	// Returns a handler answering ACME HTTP-01 challenges,
+	// other requests are passed to fallback.
+	HTTPHandler(fallback http.Handler) http.Handler
+}
+
+// Uses the CertManager for the TLS config.
+// The GetCertificate set by user is called if the CertManager returns an error,
+// such as for the hosts not allowed by [autocert.Manager.HostPolicy].
+//
+// [autocert.Manager.HostPolicy]: https://pkg.go.dev/golang.org/x/crypto/acme/autocert#Manager
+func (s *Server) setupCertManager(config *tls.Config) {
+	m := s.CertManager
+	if prev := config.GetCertificate; prev != nil {
+		config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, err := m.GetCertificate(hello)
+			if err != nil {
+				if pcert, perr := prev(hello); pcert != nil && perr == nil {
+					return pcert, nil
+				}
+			}
+			return cert, err
+		}
+	} else {
+		config.GetCertificate = m.GetCertificate
+	}
+
+	// autocert.Manager only tries HTTP-01 after HTTPHandler called.
+	s.certManagerHTTPHandler()
+
+	for _, p := range config.NextProtos {
+		if p == acmeTLS1Protocol {
+			return
+		}
+	}
+	config.NextProtos = append(config.NextProtos, acmeTLS1Protocol)
+}
+
+// Returns the HTTP-01 handler of the CertManager, created once.
+func (s *Server) certManagerHTTPHandler() http.Handler {
+	s.certManagerOnce.Do(func() {
+		s.certManagerHandler = s.CertManager.HTTPHandler(http.NotFoundHandler())
+	})
+	return s.certManagerHandler
+}
@@ -0,0 +1,296 @@
+package hlfhr
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A certificate and matching private key for [Server.KeyPairs].
+type KeyPair struct {
+	// Files containing PEM encoded data.
+	// If the certificate is signed by a certificate authority, the
+	// CertFile should be the concatenation of the server's certificate,
+	// any intermediates, and the CA's certificate.
+	CertFile string
+	KeyFile  string
+
+	// PEM encoded data, used if CertFile and KeyFile are empty.
+	CertPEM []byte
+	KeyPEM  []byte
+}
+
+func (p *KeyPair) load() (tls.Certificate, error) {
+	if p.CertFile == "" && p.KeyFile == "" && (len(p.CertPEM) != 0 || len(p.KeyPEM) != 0) {
+		return tls.X509KeyPair(p.CertPEM, p.KeyPEM)
+	}
+	return tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+}
+
+// Loaded certificates, selected by SNI.
+type certSet struct {
+	byName map[string]*tls.Certificate
+	def    *tls.Certificate
+}
+
+func newCertSet(certs []*tls.Certificate) *certSet {
+	cs := &certSet{
+		byName: make(map[string]*tls.Certificate),
+		def:    certs[0],
+	}
+	for _, cert := range certs {
+		names := cert.Leaf.DNSNames
+		if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+			names = []string{cert.Leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if _, ok := cs.byName[name]; !ok {
+				// The former one wins.
+				cs.byName[name] = cert
+			}
+		}
+	}
+	return cs
+}
+
+// Returns the certificate for the server name,
+// matching "*.example.com" for "www.example.com",
+// or the default certificate.
+func (cs *certSet) get(serverName string) *tls.Certificate {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if cert := cs.byName[name]; cert != nil {
+		return cert
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert := cs.byName["*"+name[i:]]; cert != nil {
+			return cert
+		}
+	}
+	return cs.def
+}
+
+// Loads the certificates from files, reloads them when the files change.
+type certReloader struct {
+	s     *Server
+	pairs []KeyPair
+	dir   string
+
+	set atomic.Value // *certSet
+
+	mu     sync.Mutex // serializes reloading
+	stat   string
+	loaded map[string]*tls.Certificate // by files, for keeping the old ones
+}
+
+// Loads the certificates, returns the error without logging it.
+// The first one is the default certificate.
+func newCertReloader(s *Server, pairs []KeyPair, dir string) (*certReloader, error) {
+	r := &certReloader{
+		s:     s,
+		pairs: pairs,
+		dir:   dir,
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Returns the key pairs in the directory,
+// such as "example.com.crt" and "example.com.key".
+func readKeyPairsDir(dir string) ([]KeyPair, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var pairs []KeyPair
+	for _, fi := range fis {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasSuffix(name, ".crt") {
+			continue
+		}
+		pairs = append(pairs, KeyPair{
+			CertFile: filepath.Join(dir, name),
+			KeyFile:  filepath.Join(dir, strings.TrimSuffix(name, ".crt")+".key"),
+		})
+	}
+	return pairs, nil
+}
+
+// Returns the key pairs to load, including the ones in the directory.
+func (r *certReloader) keyPairs() ([]KeyPair, error) {
+	if r.dir == "" {
+		return r.pairs, nil
+	}
+	dirPairs, err := readKeyPairsDir(r.dir)
+	if err != nil {
+		return r.pairs, err
+	}
+	pairs := make([]KeyPair, 0, len(r.pairs)+len(dirPairs))
+	pairs = append(pairs, r.pairs...)
+	return append(pairs, dirPairs...), nil
+}
+
+// Describes the files, to detect changes.
+func (r *certReloader) statFiles() string {
+	pairs, _ := r.keyPairs()
+	var b strings.Builder
+	for _, p := range pairs {
+		for _, name := range []string{p.CertFile, p.KeyFile} {
+			if name == "" {
+				continue
+			}
+			b.WriteString(name)
+			if fi, err := os.Stat(name); err == nil {
+				fmt.Fprintf(&b, " %d %d", fi.ModTime().UnixNano(), fi.Size())
+			}
+			b.WriteByte('\n')
+		}
+	}
+	return b.String()
+}
+
+// Loads the files, keeps the old certificates on error.
+func (r *certReloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Stat before loading, so that a change while loading will be reloaded next time.
+	r.stat = r.statFiles()
+
+	pairs, err := r.keyPairs()
+	loaded := make(map[string]*tls.Certificate)
+	var certs []*tls.Certificate
+	for _, p := range pairs {
+		key := p.CertFile + "\x00" + p.KeyFile
+		cert, lerr := p.load()
+		if lerr == nil && len(cert.Certificate) != 0 {
+			cert.Leaf, lerr = x509.ParseCertificate(cert.Certificate[0])
+		}
+		if lerr != nil {
+			if err == nil {
+				err = lerr
+			}
+			if old := r.loaded[key]; old != nil {
+				loaded[key] = old
+				certs = append(certs, old)
+			}
+			continue
+		}
+		loaded[key] = &cert
+		certs = append(certs, &cert)
+	}
+	if len(certs) == 0 {
+		if err == nil {
+			err = errors.New("hlfhr: no certificates")
+		}
+		return err
+	}
+	r.set.Store(newCertSet(certs))
+	r.loaded = loaded
+	return err
+}
+
+// Reloads the files if they changed.
+func (r *certReloader) reloadIfChanged() {
+	r.mu.Lock()
+	changed := r.statFiles() != r.stat
+	r.mu.Unlock()
+	if !changed {
+		return
+	}
+	// Not retrying until the files change again.
+	if err := r.reload(); err != nil {
+		r.s.logCertReloadError(err)
+	}
+}
+
+// Polls the files until done is closed.
+func (r *certReloader) poll(interval time.Duration, done <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			r.reloadIfChanged()
+		}
+	}
+}
+
+// Returns GetCertificate for the TLS config.
+// If prev is not nil, it's called first, the reloaded certificate is used
+// when it returns nil or an error.
+func (r *certReloader) getCertificateFunc(prev func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		var err error
+		if prev != nil {
+			var cert *tls.Certificate
+			if cert, err = prev(hello); cert != nil && err == nil {
+				return cert, nil
+			}
+		}
+		// Such as the hosts not allowed by CertManager.
+		if cert := r.set.Load().(*certSet).get(hello.ServerName); cert != nil {
+			return cert, nil
+		}
+		return nil, err
+	}
+}
+
+// ReloadCertificate reloads the certFile and keyFile passed to
+// [Server.ServeTLS] or [Server.ListenAndServeTLS], [Server.KeyPairs]
+// and [Server.KeyPairsDir] immediately, such as on SIGHUP.
+//
+// If some files are invalid, the error is logged and returned,
+// and the old certificates stay in use.
+func (s *Server) ReloadCertificate() error {
+	s.mu.Lock()
+	reloaders := make([]*certReloader, 0, len(s.certReloaders))
+	for r := range s.certReloaders {
+		reloaders = append(reloaders, r)
+	}
+	s.mu.Unlock()
+
+	var err error
+	for _, r := range reloaders {
+		if rerr := r.reload(); rerr != nil {
+			s.logCertReloadError(rerr)
+			if err == nil {
+				err = rerr
+			}
+		}
+	}
+	return err
+}
+
+func (s *Server) logCertReloadError(err error) {
+	s.logEvent(&Event{
+		Kind:    EventCertReloadError,
+		Err:     err,
+		Message: fmt.Sprintf("hlfhr: Reload certificate error: %v", err),
+	})
+}
+
+// Tracks the reloader for [Server.ReloadCertificate].
+func (s *Server) trackCertReloader(r *certReloader, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.certReloaders == nil {
+			s.certReloaders = make(map[*certReloader]struct{})
+		}
+		s.certReloaders[r] = struct{}{}
+	} else {
+		delete(s.certReloaders, r)
+	}
+}
@@ -1,11 +1,16 @@
 package hlfhr
 
 import (
+	"bufio"
+	"context"
 	"crypto/tls"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"runtime"
+	"time"
 
 	hlfhr_lib "github.com/bddjr/hlfhr/lib"
 	hlfhr_utils "github.com/bddjr/hlfhr/utils"
@@ -15,6 +20,47 @@ type Conn struct {
 	net.Conn
 	TLSConn *tls.Conn // If nil, it's reading TLS or serving port 80
 	Server  *Server
+
+	// HTTPS port for redirecting, if accepted by a plain HTTP listener.
+	redirectPort string
+
+	// From [http.Server.BaseContext] of the listener.
+	baseCtx context.Context
+
+	// Counted by HlfhrMaxConns, set by the accept loop of plain HTTP listeners
+	// or the serving goroutine.
+	acquired bool
+
+	// Guarded by Server.mu
+	state          http.ConnState
+	stateTime      time.Time // of the last state change
+	stateSet       bool
+	closeRequested bool
+}
+
+// Reports whether the connection is accepted by the TLS listener,
+// serving plain HTTP on the same port.
+// Otherwise it's accepted by a plain HTTP listener, such as Listen80RedirectTo443.
+func (c *Conn) IsSamePort() bool {
+	return c.TLSConn != nil
+}
+
+// Close closes the connection, unless it was hijacked by [Server.HlfhrHandler].
+//
+// If it's serving a plain HTTP request, it will be closed after the response.
+func (c *Conn) Close() error {
+	c.Server.mu.Lock()
+	switch c.state {
+	case http.StateHijacked:
+		c.Server.mu.Unlock()
+		return nil
+	case http.StateActive:
+		c.closeRequested = true
+		c.Server.mu.Unlock()
+		return nil
+	}
+	c.Server.mu.Unlock()
+	return c.Conn.Close()
 }
 
 func (c *Conn) Read(b []byte) (int, error) {
@@ -23,69 +69,374 @@ func (c *Conn) Read(b []byte) (int, error) {
 		return n, err
 	}
 
-	// TLS record types (20-23) < 'A':
-	// skip TLS, serve HTTP (A-Z) and abort via http.ErrAbortHandler.
-	if b[0] >= 'A' && b[0] <= 'Z' {
-		// HTTP
+	// Read more if the detectors need, such as a short first segment.
+	// The handshake deadline set by http.Server is still in effect.
+	if min := c.Server.detectMinBytes(); n < min {
+		if min > len(b) {
+			min = len(b)
+		}
+		for n < min {
+			m, err := c.Conn.Read(b[n:])
+			n += m
+			if err != nil {
+				break
+			}
+		}
+	}
+
+	// Serve HTTP or other protocols, then abort via http.ErrAbortHandler.
+	switch p, d := c.Server.detect(b[:n]); p {
+	case ProtocolHTTP:
 		// len(b) == 576
+		c.Server.count(func(st *Stats) { st.SamePortHTTPConns++ })
 		c.HlfhrServe(b, n)
 		panic(http.ErrAbortHandler)
+	case ProtocolOther:
+		c.Server.count(func(st *Stats) { st.OtherProtocolConns++ })
+		c.serveOther(d, b, n)
+		panic(http.ErrAbortHandler)
 	}
 
 	// Cancel hijack
+	c.Server.count(func(st *Stats) { st.TLSConns++ })
 	hlfhr_utils.TLSConnSetConn(c.TLSConn, c.Conn)
 	c.TLSConn = nil
 	return n, nil
 }
 
 func (c *Conn) HlfhrServe(b []byte, n int) {
-	defer func() {
-		if err := recover(); err != nil && err != http.ErrAbortHandler {
-			buf := make([]byte, 64<<10)
-			buf = buf[:runtime.Stack(buf, false)]
-			c.Server.logf("hlfhr: panic serving %s: %v\n%s", c.RemoteAddr(), err, buf)
-		}
-	}()
+	defer c.finish()
+	defer c.recoverPanic()
+
+	// Acquired in the accept loop of plain HTTP listeners.
+	if !c.acquired && !c.acquire() {
+		c.reject()
+		return
+	}
+	defer c.release()
+
+	ctx, cancelCtx := context.WithCancel(c.connContext())
+	defer cancelCtx()
+
+	maxHeaderBytes := int64(http.DefaultMaxHeaderBytes)
+	if c.Server.MaxHeaderBytes != 0 {
+		maxHeaderBytes = int64(c.Server.MaxHeaderBytes)
+	}
 
 	// Read request
 	limitedReader := &io.LimitedReader{
 		R: c.Conn,
-		N: http.DefaultMaxHeaderBytes,
+		N: maxHeaderBytes - int64(n),
 	}
-	if c.Server.MaxHeaderBytes != 0 {
-		limitedReader.N = int64(c.Server.MaxHeaderBytes)
-	}
-	limitedReader.N -= int64(n)
 
 	br := hlfhr_utils.NewBufioReaderWithBytes(b, n, limitedReader)
 
-	r, err := http.ReadRequest(br)
-	if err != nil {
-		c.Server.logf("hlfhr: Read request error from %s: %v", c.RemoteAddr(), err)
+	// Zero for the first request on the TLS listener,
+	// it's using the deadlines set by [http.Server].
+	var reqStart time.Time
+	c.setState(http.StateNew)
+	if n == 0 {
+		// Plain listener
+		if !c.waitFirstByte(br) {
+			return
+		}
+		reqStart = c.setRequestDeadlines()
+	}
+	c.setState(http.StateActive)
+
+	for {
+		r, err := http.ReadRequest(br)
+		if err != nil {
+			c.Server.count(func(st *Stats) { st.ReadRequestErrors++ })
+			c.logEvent(EventReadRequestError, err, fmt.Sprintf("hlfhr: Read request error from %s: %v", c.RemoteAddr(), err))
+			return
+		}
+		hlfhr_utils.BufioSetReader(br, c.Conn)
+		if !reqStart.IsZero() && c.Server.ReadHeaderTimeout > 0 {
+			// Header read, extend the deadline for the body.
+			var readDeadline time.Time
+			if d := c.Server.ReadTimeout; d > 0 {
+				readDeadline = reqStart.Add(d)
+			}
+			c.Conn.SetReadDeadline(readDeadline)
+		}
+		body := newBodyTracker(r.Body)
+		r.Body = body
+
+		keepAlive := c.Server.HlfhrKeepAlive && !r.Close && !c.Server.shuttingDown()
+
+		// Response
+		w := hlfhr_lib.NewResponseWithOptions(c.Conn, 400, !keepAlive, hlfhr_lib.ResponseOptions{
+			Reader:  br,
+			Request: r,
+		})
+		if keepAlive && !r.ProtoAtLeast(1, 1) {
+			w.Header()["Connection"] = []string{"keep-alive"}
+		}
+
+		if max := c.Server.HlfhrMaxBodyBytes; max > 0 && r.ContentLength > max {
+			// Error: request body too large
+			keepAlive = false
+			w.SetCloseConnection(true)
+			w.WriteHeader(413)
+			w.WriteString("request body too large")
+		} else {
+			if max > 0 {
+				r.Body = http.MaxBytesReader(w, r.Body, max)
+			}
+			reqCtx, cancelReq := context.WithCancel(ctx)
+			c.serveRequest(w, c.prepareRequest(reqCtx, r))
+			cancelReq()
+			if w.Hijacked() {
+				c.setState(http.StateHijacked)
+				return
+			}
+		}
+
+		if keepAlive && (w.CloseConnection() || !discardBody(body)) {
+			keepAlive = false
+			w.SetCloseConnection(true)
+		}
+
+		// Write
+		err = w.Finish()
+		if err != nil {
+			c.Server.count(func(st *Stats) { st.WriteErrors++ })
+			c.logEvent(EventWriteError, err, fmt.Sprintf("hlfhr: Write error for %s: %v", c.RemoteAddr(), err))
+			return
+		}
+
+		if !keepAlive || w.CloseConnection() {
+			if !body.eof {
+				c.lingeringClose()
+			}
+			return
+		}
+		c.setState(http.StateIdle)
+		if c.Server.shuttingDown() || !c.waitNextRequest(br) || c.Server.shuttingDown() {
+			return
+		}
+		c.setState(http.StateActive)
+		reqStart = c.setRequestDeadlines()
+		limitedReader.N = maxHeaderBytes
+		hlfhr_utils.BufioSetReader(br, limitedReader)
+	}
+}
+
+// Sets the state of the plain HTTP connection, tracks it,
+// and calls [Server.HlfhrConnState].
+func (c *Conn) setState(state http.ConnState) {
+	s := c.Server
+	s.mu.Lock()
+	if c.stateSet && c.state == state {
+		s.mu.Unlock()
 		return
 	}
-	hlfhr_utils.BufioSetReader(br, c.Conn)
+	c.state = state
+	c.stateTime = time.Now()
+	c.stateSet = true
+	switch state {
+	case http.StateNew, http.StateActive, http.StateIdle:
+		if s.conns == nil {
+			s.conns = make(map[*Conn]struct{})
+		}
+		s.conns[c] = struct{}{}
+	case http.StateHijacked, http.StateClosed:
+		delete(s.conns, c)
+	}
+	s.mu.Unlock()
 
-	// Response
-	w := hlfhr_lib.NewResponse(c.Conn, 400, true)
+	if hook := s.HlfhrConnState; hook != nil {
+		hook(c, state)
+	}
+}
 
+// Untracks the connection, closes it if requested.
+func (c *Conn) finish() {
+	c.Server.mu.Lock()
+	state := c.state
+	stateSet := c.stateSet
+	closeRequested := c.closeRequested
+	c.Server.mu.Unlock()
+	if state == http.StateHijacked || !stateSet {
+		// Hijacked or rejected
+		return
+	}
+	c.setState(http.StateClosed)
+	if closeRequested {
+		c.Conn.Close()
+	}
+}
+
+func (c *Conn) serveRequest(w *hlfhr_lib.Response, r *http.Request) {
 	if r.Host == "" {
 		// Error: missing HTTP/1.1 required "Host" header
 		w.WriteString("missing required Host header")
+	} else if c.Server.rejectUnknownHost(w, r) {
+		// Error: unknown host
+	} else if c.Server.serveACMEChallenge(w, r) {
+		// ACME HTTP-01 challenge
 	} else if c.Server.HlfhrHandler != nil {
 		// Handler
+		c.Server.count(func(st *Stats) { st.HlfhrHandlerCalls++ })
 		c.Server.HlfhrHandler.ServeHTTP(w, r)
 	} else if c.TLSConn != nil {
-		// Redirect
-		hlfhr_utils.RedirectToHttps_ForceSamePort(w, r, 307)
+		// Redirect to the same port
+		_, port, _ := hlfhr_utils.SplitHost(r.Host)
+		if port == "" {
+			port = "80"
+		}
+		c.Server.redirectPolicy().redirect(w, r, port)
+		c.Server.countRedirect(w.Status())
+	} else {
+		// Listen80RedirectTo443 or ListenRedirects
+		c.Server.redirectPolicy().redirect(w, r, c.redirectPort)
+		c.Server.countRedirect(w.Status())
+	}
+}
+
+// Waits for the first byte on a plain listener,
+// reports whether it can be read.
+func (c *Conn) waitFirstByte(br *bufio.Reader) bool {
+	timeout := c.Server.HlfhrFirstByteTimeout
+	if timeout == 0 {
+		timeout = c.Server.ReadHeaderTimeout
+	}
+	if timeout == 0 {
+		timeout = c.Server.ReadTimeout
+	}
+	return c.peek(br, timeout)
+}
+
+// Waits for the next request on a keep-alive connection,
+// reports whether it can be read.
+func (c *Conn) waitNextRequest(br *bufio.Reader) bool {
+	if br.Buffered() != 0 {
+		// Pipelined
+		return true
+	}
+	// Idle
+	timeout := c.Server.IdleTimeout
+	if timeout == 0 {
+		timeout = c.Server.ReadTimeout
+	}
+	return c.peek(br, timeout)
+}
+
+// Peeks a byte with the read timeout, if the timeout is not zero.
+func (c *Conn) peek(br *bufio.Reader, timeout time.Duration) bool {
+	if timeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(timeout))
 	} else {
-		// Listen80RedirectTo443
-		hlfhr_utils.RedirectToHttps(w, r, 307)
+		c.Conn.SetReadDeadline(time.Time{})
+	}
+	_, err := br.Peek(1)
+	return err == nil
+}
+
+// Sets the read and write deadlines for a new request, returns the start time.
+func (c *Conn) setRequestDeadlines() time.Time {
+	now := time.Now()
+	var readDeadline, writeDeadline time.Time
+	if d := c.Server.ReadHeaderTimeout; d > 0 {
+		readDeadline = now.Add(d)
+	} else if d := c.Server.ReadTimeout; d > 0 {
+		readDeadline = now.Add(d)
+	}
+	if d := c.Server.WriteTimeout; d > 0 {
+		writeDeadline = now.Add(d)
+	}
+	c.Conn.SetReadDeadline(readDeadline)
+	c.Conn.SetWriteDeadline(writeDeadline)
+	return now
+}
+
+// Max bytes of unread request body to discard for keep-alive,
+// or before closing the connection.
+const maxDiscardBodyBytes = 256 << 10
+
+// Max time to wait for the client before closing the connection.
+const lingerTimeout = 500 * time.Millisecond
+
+// Discards the unread request body, reports whether it's fully read.
+func discardBody(body io.ReadCloser) bool {
+	n, err := io.CopyN(ioutil.Discard, body, maxDiscardBodyBytes+1)
+	return err == io.EOF && n <= maxDiscardBodyBytes
+}
+
+// Records whether the request body is fully read.
+type bodyTracker struct {
+	io.ReadCloser
+	eof bool
+}
+
+func newBodyTracker(body io.ReadCloser) *bodyTracker {
+	return &bodyTracker{
+		ReadCloser: body,
+		eof:        body == nil || body == http.NoBody,
+	}
+}
+
+func (b *bodyTracker) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+// Closes the write side and drains the unread bytes for a while,
+// so that the client can read the response instead of getting a TCP RST.
+func (c *Conn) lingeringClose() {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
 	}
+	c.Conn.SetReadDeadline(time.Now().Add(lingerTimeout))
+	io.CopyN(ioutil.Discard, c.Conn, maxDiscardBodyBytes)
+}
+
+func (c *Conn) recoverPanic() {
+	if err := recover(); err != nil && err != http.ErrAbortHandler {
+		buf := make([]byte, 64<<10)
+		buf = buf[:runtime.Stack(buf, false)]
+		c.Server.count(func(st *Stats) { st.Panics++ })
+		perr, ok := err.(error)
+		if !ok {
+			perr = fmt.Errorf("%v", err)
+		}
+		c.Server.logEvent(&Event{
+			Kind:       EventPanic,
+			RemoteAddr: addrString(c.RemoteAddr()),
+			Listener:   addrString(c.LocalAddr()),
+			Err:        perr,
+			Stack:      buf,
+			Message:    fmt.Sprintf("hlfhr: panic serving %s: %v", c.RemoteAddr(), err),
+		})
+	}
+}
+
+func (c *Conn) serveOther(d Detector, b []byte, n int) {
+	defer c.recoverPanic()
 
-	// Write
-	err = w.FlushError()
-	if err != nil {
-		c.Server.logf("hlfhr: Write error for %s: %v", c.RemoteAddr(), err)
+	h, ok := d.(ConnHandler)
+	if !ok {
+		c.logEvent(EventDetectorError, nil, fmt.Sprintf("hlfhr: detector %T does not implement ConnHandler, closing %s", d, c.RemoteAddr()))
+		return
 	}
+	// Clear the handshake deadline set by http.Server.
+	c.Conn.SetDeadline(time.Time{})
+	h.ServeConn(&bufferedConn{
+		Conn: c.Conn,
+		r:    hlfhr_utils.NewBufioReaderWithBytes(b, n, c.Conn),
+	})
+}
+
+// Reads the bytes already read from the connection first.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
 }
@@ -0,0 +1,50 @@
+package hlfhr
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// Returns the context of [http.Server.BaseContext] for the listener l.
+//
+// For the TLS listener, it's called once more than http.Server does.
+func (s *Server) baseContext(l net.Listener) context.Context {
+	if s.BaseContext == nil {
+		return context.Background()
+	}
+	ctx := s.BaseContext(l)
+	if ctx == nil {
+		panic("hlfhr: BaseContext returned a nil context")
+	}
+	return ctx
+}
+
+// Returns the context of the plain HTTP connection, like [http.Server],
+// with [http.ServerContextKey], [http.LocalAddrContextKey],
+// and [http.Server.ConnContext].
+//
+// On the TLS listener, http.Server has already called ConnContext with the
+// [crypto/tls.Conn], it's called again with the [Conn] after plain HTTP detected.
+func (c *Conn) connContext() context.Context {
+	ctx := c.baseCtx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx = context.WithValue(ctx, http.ServerContextKey, c.Server.Server)
+	ctx = context.WithValue(ctx, http.LocalAddrContextKey, c.LocalAddr())
+	if cc := c.Server.ConnContext; cc != nil {
+		ctx = cc(ctx, c)
+		if ctx == nil {
+			panic("hlfhr: ConnContext returned a nil context")
+		}
+	}
+	return ctx
+}
+
+// Sets the fields of the request like [http.Server],
+// such as RemoteAddr, with the context ctx.
+func (c *Conn) prepareRequest(ctx context.Context, r *http.Request) *http.Request {
+	r.RemoteAddr = c.RemoteAddr().String()
+	return r.WithContext(ctx)
+}
@@ -0,0 +1,127 @@
+package hlfhr
+
+import (
+	"bytes"
+	"net"
+)
+
+// Protocol returned by [Detector.Detect].
+type Protocol uint8
+
+const (
+	// Let the next detector decide.
+	ProtocolUnknown Protocol = iota
+
+	// Continue the TLS handshake.
+	ProtocolTLS
+
+	// Serve plain HTTP, see [Conn.HlfhrServe].
+	ProtocolHTTP
+
+	// Pass the connection to the [ConnHandler] implemented by the detector,
+	// then close it.
+	ProtocolOther
+)
+
+// Detector decides which protocol a connection on the TLS listener speaks.
+type Detector interface {
+	// Detect is called with the first bytes read from the connection.
+	// b must not be modified or retained.
+	//
+	// If it returns [ProtocolOther], the detector must implement [ConnHandler],
+	// otherwise the connection will be closed.
+	Detect(b []byte) Protocol
+}
+
+// MinBytesDetector is a [Detector] needing at least MinBytes bytes to decide,
+// such as [PrefixDetector].
+//
+// If the first read from the connection is shorter, the TLS listener keeps
+// reading until the longest MinBytes of [Server.Detectors] arrived,
+// up to the size of the TLS read buffer, before calling the detectors.
+// Other detectors may get fewer bytes than they need.
+type MinBytesDetector interface {
+	Detector
+	MinBytes() int
+}
+
+// DetectorFunc is an adapter to allow the use of ordinary functions as [Detector].
+type DetectorFunc func(b []byte) Protocol
+
+func (f DetectorFunc) Detect(b []byte) Protocol {
+	return f(b)
+}
+
+// ConnHandler serves a connection of [ProtocolOther].
+type ConnHandler interface {
+	// The bytes passed to [Detector.Detect] can be read again from c.
+	// c will be closed after ServeConn returns.
+	//
+	// c has no deadline, even if the timeouts of [http.Server] are set,
+	// long-lived protocols should set their own deadlines.
+	ServeConn(c net.Conn)
+}
+
+// ConnHandlerFunc is an adapter to allow the use of ordinary functions as [ConnHandler].
+type ConnHandlerFunc func(c net.Conn)
+
+func (f ConnHandlerFunc) ServeConn(c net.Conn) {
+	f(c)
+}
+
+// PrefixDetector passes connections starting with Prefix to Handler.
+//
+// For example, SSH connections starts with "SSH-".
+//
+// It implements [MinBytesDetector], so a short first read
+// of the prefix is not detected as TLS.
+type PrefixDetector struct {
+	Prefix  []byte
+	Handler ConnHandler
+}
+
+func (d *PrefixDetector) Detect(b []byte) Protocol {
+	if len(d.Prefix) != 0 && bytes.HasPrefix(b, d.Prefix) {
+		return ProtocolOther
+	}
+	return ProtocolUnknown
+}
+
+func (d *PrefixDetector) MinBytes() int {
+	return len(d.Prefix)
+}
+
+func (d *PrefixDetector) ServeConn(c net.Conn) {
+	d.Handler.ServeConn(c)
+}
+
+// DefaultDetect is the detection used when no [Server.Detectors] decided.
+//
+// TLS record types (20-23) < 'A':
+// skip TLS, serve HTTP (A-Z).
+func DefaultDetect(b []byte) Protocol {
+	if len(b) != 0 && b[0] >= 'A' && b[0] <= 'Z' {
+		return ProtocolHTTP
+	}
+	return ProtocolTLS
+}
+
+// Returns the bytes needed by the detectors.
+func (s *Server) detectMinBytes() int {
+	min := 1
+	for _, d := range s.Detectors {
+		if md, ok := d.(MinBytesDetector); ok && md.MinBytes() > min {
+			min = md.MinBytes()
+		}
+	}
+	return min
+}
+
+func (s *Server) detect(b []byte) (Protocol, Detector) {
+	for _, d := range s.Detectors {
+		if p := d.Detect(b); p != ProtocolUnknown {
+			return p, d
+		}
+	}
+	return DefaultDetect(b), nil
+}
@@ -0,0 +1,170 @@
+package hlfhr
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+// DevCert generates a local CA and a certificate signed by it for development,
+// see [Server.DevCert].
+type DevCert struct {
+	// Hostnames or IP addresses to cover,
+	// in addition to "localhost", "127.0.0.1" and "::1".
+	Hosts []string
+
+	// If both are set, the CA is loaded from the files,
+	// or generated and written to the files if they do not exist.
+	// Add the CACertFile to the trusted roots of your system or browser,
+	// the certificates generated later will be trusted.
+	//
+	// If both are empty, a new CA is generated in memory every time.
+	CACertFile string
+	CAKeyFile  string
+}
+
+var devCertDefaultHosts = []string{"localhost", "127.0.0.1", "::1"}
+
+// Returns the PEM encoded certificate chain and private key.
+func (d *DevCert) generate() (certPEM []byte, keyPEM []byte, err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("hlfhr: DevCert error: %v", err)
+		}
+	}()
+
+	ca, caKey, err := d.loadOrCreateCA()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl, err := devCertTemplate("hlfhr development certificate", 365*24*time.Hour)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, h := range append(devCertDefaultHosts, d.Hosts...) {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else if h != "" {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, key.Public(), caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})...)
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+func (d *DevCert) loadOrCreateCA() (*x509.Certificate, crypto.Signer, error) {
+	if (d.CACertFile == "") != (d.CAKeyFile == "") {
+		return nil, nil, errors.New("CACertFile and CAKeyFile must be set together")
+	}
+	if d.CACertFile != "" {
+		_, err1 := os.Stat(d.CACertFile)
+		_, err2 := os.Stat(d.CAKeyFile)
+		if err1 == nil || err2 == nil {
+			return loadDevCA(d.CACertFile, d.CAKeyFile)
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl, err := devCertTemplate("hlfhr development CA", 10*365*24*time.Hour)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	tmpl.BasicConstraintsValid = true
+	tmpl.IsCA = true
+	tmpl.MaxPathLenZero = true
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if d.CACertFile != "" {
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = ioutil.WriteFile(d.CAKeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = ioutil.WriteFile(d.CACertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return ca, key, nil
+}
+
+func loadDevCA(certFile, keyFile string) (*x509.Certificate, crypto.Signer, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ca.IsCA {
+		return nil, nil, errors.New(certFile + " is not a CA certificate")
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, errors.New(keyFile + " is not a signing key")
+	}
+	return ca, key, nil
+}
+
+func devCertTemplate(commonName string, validFor time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"hlfhr development"},
+			CommonName:   commonName,
+		},
+		// Tolerate clock skew.
+		NotBefore: now.Add(-time.Hour),
+		NotAfter:  now.Add(validFor),
+	}, nil
+}
@@ -0,0 +1,133 @@
+package hlfhr
+
+import (
+	"container/list"
+	"net"
+	"time"
+
+	hlfhr_lib "github.com/bddjr/hlfhr/lib"
+)
+
+// Max count of client IPs tracked by HlfhrRateLimit,
+// the least recently used one is evicted.
+const maxRateBuckets = 4096
+
+// Max count of rejected connections responding HlfhrRejectCode concurrently,
+// the others are closed without response.
+const maxRejectingConns = 256
+
+// Token bucket of a client IP.
+type rateBucket struct {
+	ip     string
+	tokens float64
+	last   time.Time
+}
+
+// Reports whether the plain HTTP connection can be served,
+// counts it until [Conn.release] if so.
+func (c *Conn) acquire() bool {
+	s := c.Server
+	ip := ""
+	if s.HlfhrRateLimit > 0 {
+		ip, _, _ = net.SplitHostPort(addrString(c.RemoteAddr()))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if max := s.HlfhrMaxConns; max > 0 && s.hlfhrConns >= max {
+		s.count(func(st *Stats) { st.MaxConnsRejected++ })
+		return false
+	}
+	if s.HlfhrRateLimit > 0 && !s.allowRateLocked(ip, time.Now()) {
+		s.count(func(st *Stats) { st.RateLimitRejected++ })
+		return false
+	}
+	s.hlfhrConns++
+	c.acquired = true
+	return true
+}
+
+func (c *Conn) release() {
+	if c.acquired {
+		c.Server.mu.Lock()
+		c.Server.hlfhrConns--
+		c.Server.mu.Unlock()
+		c.acquired = false
+	}
+}
+
+// Takes a token from the bucket of the IP.
+func (s *Server) allowRateLocked(ip string, now time.Time) bool {
+	burst := float64(s.HlfhrRateBurst)
+	if burst < 1 {
+		burst = 1
+	}
+	var b *rateBucket
+	if e := s.rateBuckets[ip]; e != nil {
+		s.rateLRU.MoveToFront(e)
+		b = e.Value.(*rateBucket)
+		b.tokens += now.Sub(b.last).Seconds() * s.HlfhrRateLimit
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+		b.last = now
+	} else {
+		if s.rateBuckets == nil {
+			s.rateBuckets = make(map[string]*list.Element)
+		}
+		if s.rateLRU.Len() >= maxRateBuckets {
+			// Evict the least recently used one.
+			e := s.rateLRU.Back()
+			s.rateLRU.Remove(e)
+			delete(s.rateBuckets, e.Value.(*rateBucket).ip)
+		}
+		b = &rateBucket{ip: ip, tokens: burst, last: now}
+		s.rateBuckets[ip] = s.rateLRU.PushFront(b)
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Rejects the connection accepted by a plain HTTP listener,
+// without blocking the accept loop.
+func (s *Server) rejectPlain(c *Conn) {
+	if s.HlfhrRejectCode == 0 {
+		c.Conn.Close()
+		return
+	}
+	s.mu.Lock()
+	ok := s.rejectingConns < maxRejectingConns
+	if ok {
+		s.rejectingConns++
+	}
+	s.mu.Unlock()
+	if !ok {
+		c.Conn.Close()
+		return
+	}
+	go func() {
+		defer func() {
+			s.mu.Lock()
+			s.rejectingConns--
+			s.mu.Unlock()
+		}()
+		c.reject()
+		c.Conn.Close()
+	}()
+}
+
+// Responds HlfhrRejectCode without reading the request, if it's not zero.
+func (c *Conn) reject() {
+	code := c.Server.HlfhrRejectCode
+	if code == 0 {
+		return
+	}
+	c.Conn.SetWriteDeadline(time.Now().Add(lingerTimeout))
+	w := hlfhr_lib.NewResponse(c.Conn, code, true)
+	w.Header().Set("Retry-After", "1")
+	w.FlushError()
+	c.lingeringClose()
+}
@@ -0,0 +1,212 @@
+package hlfhr
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// EventKind is the kind of [Event].
+type EventKind uint8
+
+const (
+	// Reading a plain HTTP request failed,
+	// such as a malformed request from scanners.
+	EventReadRequestError EventKind = iota + 1
+
+	// Writing a plain HTTP response failed.
+	EventWriteError
+
+	// A panic recovered while serving plain HTTP or other protocols.
+	EventPanic
+
+	// Accepting on a plain HTTP listener failed, it will be retried.
+	EventListenerError
+
+	// A request rejected by [Server.AllowedHosts].
+	EventUnknownHost
+
+	// Reloading certificates failed, the old ones stay in use.
+	EventCertReloadError
+
+	// A detector returned [ProtocolOther] without implementing [ConnHandler].
+	EventDetectorError
+
+	// Reading the PROXY protocol header failed, the connection is closed,
+	// see [Server.ProxyProtocol].
+	EventProxyProtocolError
+)
+
+var eventKindNames = [...]string{
+	EventReadRequestError: "read_request_error",
+	EventWriteError:       "write_error",
+	EventPanic:            "panic",
+	EventListenerError:    "listener_error",
+	EventUnknownHost:      "unknown_host",
+	EventCertReloadError:  "cert_reload_error",
+	EventDetectorError:    "detector_error",
+
+	EventProxyProtocolError: "proxy_protocol_error",
+}
+
+func (k EventKind) String() string {
+	if int(k) < len(eventKindNames) && eventKindNames[k] != "" {
+		return eventKindNames[k]
+	}
+	return fmt.Sprintf("EventKind(%d)", k)
+}
+
+// Event is passed to [Logger].
+type Event struct {
+	Kind EventKind
+
+	// Address of the client, may be empty.
+	RemoteAddr string
+
+	// Address of the listener, may be empty.
+	Listener string
+
+	// May be nil, such as EventUnknownHost.
+	Err error
+
+	// Stack trace of EventPanic.
+	Stack []byte
+
+	// Count of the events of the same kind dropped before this one,
+	// see [NewRateLimitLogger].
+	Suppressed int
+
+	// Human-readable message, such as
+	// "hlfhr: Read request error from 192.0.2.1:1234: EOF".
+	Message string
+}
+
+// String returns the message, with the count of suppressed events
+// and the stack trace if any.
+func (e *Event) String() string {
+	msg := e.Message
+	if e.Suppressed > 0 {
+		msg += fmt.Sprintf(" (%d similar events suppressed)", e.Suppressed)
+	}
+	if len(e.Stack) != 0 {
+		msg += "\n" + string(e.Stack)
+	}
+	return msg
+}
+
+// Logger receives the events of [Server].
+type Logger interface {
+	Log(e *Event)
+}
+
+// LoggerFunc is an adapter to allow the use of ordinary functions as [Logger].
+type LoggerFunc func(e *Event)
+
+func (f LoggerFunc) Log(e *Event) {
+	f(e)
+}
+
+// NewLogLogger returns a [Logger] printing the messages to l.
+// If l is nil, the standard logger of package log is used.
+func NewLogLogger(l *log.Logger) Logger {
+	return LoggerFunc(func(e *Event) {
+		if l != nil {
+			l.Print(e.String())
+		} else {
+			log.Print(e.String())
+		}
+	})
+}
+
+// NewRateLimitLogger returns a [Logger] passing at most burst events
+// of each kind to l, then one event every interval,
+// such as against the noisy scanners.
+// The count of dropped events is reported by [Event.Suppressed].
+func NewRateLimitLogger(l Logger, interval time.Duration, burst int) Logger {
+	return &rateLimitLogger{
+		l:        l,
+		interval: interval,
+		burst:    burst,
+		buckets:  make(map[EventKind]*logBucket),
+	}
+}
+
+type rateLimitLogger struct {
+	l        Logger
+	interval time.Duration
+	burst    int
+
+	mu      sync.Mutex
+	buckets map[EventKind]*logBucket
+}
+
+type logBucket struct {
+	tokens     int
+	last       time.Time
+	suppressed int
+}
+
+func (rl *rateLimitLogger) Log(e *Event) {
+	now := time.Now()
+	rl.mu.Lock()
+	b := rl.buckets[e.Kind]
+	if b == nil {
+		b = &logBucket{tokens: rl.burst, last: now}
+		rl.buckets[e.Kind] = b
+	} else if rl.interval > 0 {
+		// Refill
+		if n := int(now.Sub(b.last) / rl.interval); n > 0 {
+			b.tokens += n
+			if b.tokens > rl.burst {
+				b.tokens = rl.burst
+			}
+			b.last = b.last.Add(time.Duration(n) * rl.interval)
+		}
+	}
+	if b.tokens <= 0 {
+		b.suppressed++
+		rl.mu.Unlock()
+		return
+	}
+	b.tokens--
+	suppressed := b.suppressed
+	b.suppressed = 0
+	rl.mu.Unlock()
+
+	if suppressed > 0 {
+		ec := *e
+		ec.Suppressed += suppressed
+		e = &ec
+	}
+	rl.l.Log(e)
+}
+
+// Passes the event to [Server.Logger], or prints the message
+// to [http.Server.ErrorLog] or the standard logger.
+func (s *Server) logEvent(e *Event) {
+	if s.Logger != nil {
+		s.Logger.Log(e)
+		return
+	}
+	s.logf("%s", e.String())
+}
+
+// Logs the event of the connection.
+func (c *Conn) logEvent(kind EventKind, err error, message string) {
+	c.Server.logEvent(&Event{
+		Kind:       kind,
+		RemoteAddr: addrString(c.RemoteAddr()),
+		Listener:   addrString(c.LocalAddr()),
+		Err:        err,
+		Message:    message,
+	})
+}
+
+func addrString(a net.Addr) string {
+	if a == nil {
+		return ""
+	}
+	return a.String()
+}
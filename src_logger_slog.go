@@ -0,0 +1,44 @@
+//go:build go1.21
+// +build go1.21
+
+package hlfhr
+
+import (
+	"context"
+	"log/slog"
+)
+
+// NewSlogLogger returns a [Logger] writing the events to l.
+// EventReadRequestError and EventUnknownHost are logged at warn level,
+// others at error level.
+// If l is nil, [slog.Default] is used.
+func NewSlogLogger(l *slog.Logger) Logger {
+	return LoggerFunc(func(e *Event) {
+		logger := l
+		if logger == nil {
+			logger = slog.Default()
+		}
+		level := slog.LevelError
+		switch e.Kind {
+		case EventReadRequestError, EventUnknownHost:
+			level = slog.LevelWarn
+		}
+		attrs := []slog.Attr{slog.String("kind", e.Kind.String())}
+		if e.RemoteAddr != "" {
+			attrs = append(attrs, slog.String("remote_addr", e.RemoteAddr))
+		}
+		if e.Listener != "" {
+			attrs = append(attrs, slog.String("listener", e.Listener))
+		}
+		if e.Err != nil {
+			attrs = append(attrs, slog.String("error", e.Err.Error()))
+		}
+		if len(e.Stack) != 0 {
+			attrs = append(attrs, slog.String("stack", string(e.Stack)))
+		}
+		if e.Suppressed > 0 {
+			attrs = append(attrs, slog.Int("suppressed", e.Suppressed))
+		}
+		logger.LogAttrs(context.Background(), level, e.Message, attrs...)
+	})
+}
@@ -0,0 +1,290 @@
+package hlfhr
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Default timeout for reading the PROXY protocol header,
+// see [Server.ProxyProtocolTimeout].
+const defaultProxyProtocolTimeout = 10 * time.Second
+
+// Returns the timeout for reading the PROXY protocol header.
+func (s *Server) proxyProtocolTimeout() time.Duration {
+	if s.ProxyProtocolTimeout != 0 {
+		return s.ProxyProtocolTimeout
+	}
+	if s.ReadHeaderTimeout != 0 {
+		return s.ReadHeaderTimeout
+	}
+	return defaultProxyProtocolTimeout
+}
+
+// Accepts connections and reads their PROXY protocol headers in background,
+// so that a slow client does not block accepting the others,
+// and the addresses are parsed before the connections are returned.
+type proxyProtocolListener struct {
+	net.Listener
+	s *Server
+
+	once  sync.Once
+	conns chan net.Conn
+	done  chan struct{}
+	err   error // set before done is closed
+}
+
+func newProxyProtocolListener(l net.Listener, s *Server) *proxyProtocolListener {
+	return &proxyProtocolListener{
+		Listener: l,
+		s:        s,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	l.once.Do(func() {
+		go l.serve()
+	})
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// Accepts until the listener failed, retries temporary errors.
+func (l *proxyProtocolListener) serve() {
+	var tempDelay time.Duration
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			if l.s.retryAccept(l.Listener, err, &tempDelay) {
+				continue
+			}
+			l.err = err
+			close(l.done)
+			return
+		}
+		tempDelay = 0
+		go l.readHeader(c)
+	}
+}
+
+func (l *proxyProtocolListener) readHeader(c net.Conn) {
+	pc := newProxyProtocolConn(c, l.s.proxyProtocolTimeout())
+	if err := pc.init(); err != nil {
+		l.s.logEvent(&Event{
+			Kind:       EventProxyProtocolError,
+			RemoteAddr: addrString(c.RemoteAddr()),
+			Listener:   addrString(c.LocalAddr()),
+			Err:        err,
+			Message:    fmt.Sprintf("%v from %s", err, c.RemoteAddr()),
+		})
+		c.Close()
+		return
+	}
+	select {
+	case l.conns <- pc:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+// Strips and parses the PROXY protocol v1/v2 header on first read.
+//
+// Until the header is parsed, RemoteAddr and LocalAddr return the addresses
+// of the socket, such as the load balancer.
+type proxyProtocolConn struct {
+	net.Conn
+	timeout time.Duration
+
+	once       sync.Once
+	parsed     uint32 // accessed atomically, set after the header parsed
+	err        error
+	br         *bufio.Reader
+	remoteAddr net.Addr
+	localAddr  net.Addr
+
+	deadlineMu   sync.Mutex
+	readDeadline time.Time
+}
+
+func newProxyProtocolConn(c net.Conn, timeout time.Duration) *proxyProtocolConn {
+	return &proxyProtocolConn{
+		Conn:       c,
+		timeout:    timeout,
+		remoteAddr: c.RemoteAddr(),
+		localAddr:  c.LocalAddr(),
+	}
+}
+
+func (c *proxyProtocolConn) init() error {
+	c.once.Do(func() {
+		if c.timeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		}
+		c.br = bufio.NewReaderSize(c.Conn, 256)
+		c.err = c.readHeader()
+		if c.err != nil {
+			c.err = fmt.Errorf("hlfhr: PROXY protocol error: %v", c.err)
+		} else {
+			atomic.StoreUint32(&c.parsed, 1)
+		}
+
+		// Restore the deadline set by user.
+		c.deadlineMu.Lock()
+		c.Conn.SetReadDeadline(c.readDeadline)
+		c.deadlineMu.Unlock()
+	})
+	return c.err
+}
+
+func (c *proxyProtocolConn) readHeader() error {
+	b, err := c.br.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(b, proxyProtocolV2Signature) {
+		return c.readHeaderV2()
+	}
+	if bytes.HasPrefix(b, []byte("PROXY ")) {
+		return c.readHeaderV1()
+	}
+	return errors.New("missing header")
+}
+
+func (c *proxyProtocolConn) readHeaderV1() error {
+	// The maximum length of the header is 107 bytes.
+	line, err := c.br.ReadSlice('\n')
+	if err != nil {
+		return err
+	}
+	if len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return errors.New("invalid v1 header")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	switch {
+	case len(fields) >= 2 && fields[1] == "UNKNOWN":
+		return nil
+	case len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6"):
+		return errors.New("invalid v1 header")
+	}
+	src := net.ParseIP(fields[2])
+	dst := net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if src == nil || dst == nil || err1 != nil || err2 != nil {
+		return errors.New("invalid v1 header")
+	}
+	c.remoteAddr = &net.TCPAddr{IP: src, Port: int(srcPort)}
+	c.localAddr = &net.TCPAddr{IP: dst, Port: int(dstPort)}
+	return nil
+}
+
+func (c *proxyProtocolConn) readHeaderV2() error {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(c.br, hdr); err != nil {
+		return err
+	}
+	if hdr[12]>>4 != 2 {
+		return errors.New("invalid v2 version")
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(c.br, body); err != nil {
+		return err
+	}
+
+	switch hdr[12] & 0xF {
+	case 0:
+		// LOCAL, such as health checks, keep the original addresses.
+		return nil
+	case 1:
+		// PROXY
+	default:
+		return errors.New("invalid v2 command")
+	}
+
+	var ipLen int
+	switch hdr[13] >> 4 {
+	case 1:
+		ipLen = net.IPv4len
+	case 2:
+		ipLen = net.IPv6len
+	default:
+		// AF_UNSPEC or AF_UNIX, keep the original addresses.
+		return nil
+	}
+	if len(body) < ipLen*2+4 {
+		return errors.New("invalid v2 address length")
+	}
+	src := make(net.IP, ipLen)
+	dst := make(net.IP, ipLen)
+	copy(src, body)
+	copy(dst, body[ipLen:])
+	srcPort := binary.BigEndian.Uint16(body[ipLen*2:])
+	dstPort := binary.BigEndian.Uint16(body[ipLen*2+2:])
+
+	// The transport protocol is not checked.
+	c.remoteAddr = &net.TCPAddr{IP: src, Port: int(srcPort)}
+	c.localAddr = &net.TCPAddr{IP: dst, Port: int(dstPort)}
+	return nil
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	if err := c.init(); err != nil {
+		return 0, err
+	}
+	if c.br.Buffered() > 0 {
+		return c.br.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	if atomic.LoadUint32(&c.parsed) == 0 {
+		return c.Conn.RemoteAddr()
+	}
+	return c.remoteAddr
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	if atomic.LoadUint32(&c.parsed) == 0 {
+		return c.Conn.LocalAddr()
+	}
+	return c.localAddr
+}
+
+func (c *proxyProtocolConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (c *proxyProtocolConn) SetDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyProtocolConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
@@ -0,0 +1,154 @@
+package hlfhr
+
+import (
+	"net/http"
+	"strings"
+
+	hlfhr_utils "github.com/bddjr/hlfhr/utils"
+)
+
+// RedirectPolicy decides how plain HTTP requests are redirected to HTTPS,
+// see [Server.RedirectPolicy].
+//
+// The zero value redirects to the same host and path with 307.
+type RedirectPolicy struct {
+	// Status code for GET and HEAD requests, such as 301.
+	//
+	// If zero, it's 307.
+	Code int
+
+	// Status code for other methods, such as 308.
+	//
+	// If zero, it's the same as Code, except that 301 becomes 308
+	// and 302 becomes 307, so the method and body are kept.
+	CodeOtherMethods int
+
+	// Canonical hostname of the target, such as "example.com".
+	//
+	// If empty, the hostname of the request is used.
+	Host string
+
+	// Hostnames redirected to Host, such as "www.example.com".
+	// Other hostnames are kept.
+	//
+	// If empty, all hostnames are redirected to Host.
+	HostAliases []string
+
+	// HTTPS port of the target, such as "8443".
+	//
+	// If empty, it's the port of the request on the TLS listener,
+	// or the ToPort of the plain HTTP listener.
+	Port string
+
+	// Redirect to "/" instead of the path of the request.
+	DiscardPath bool
+
+	// Remove the query of the request.
+	DiscardQuery bool
+}
+
+var defaultRedirectPolicy = &RedirectPolicy{}
+
+// Returns the status code for the request method.
+func (p *RedirectPolicy) code(method string) int {
+	code := p.Code
+	if code == 0 {
+		code = 307
+	}
+	if method == "GET" || method == "HEAD" {
+		return code
+	}
+	if p.CodeOtherMethods != 0 {
+		return p.CodeOtherMethods
+	}
+	switch code {
+	case 301:
+		return 308
+	case 302, 303:
+		return 307
+	}
+	return code
+}
+
+// Returns the target hostname for the request hostname.
+func (p *RedirectPolicy) hostname(hostname string) string {
+	if p.Host == "" {
+		return hostname
+	}
+	if len(p.HostAliases) == 0 {
+		return p.Host
+	}
+	for _, alias := range p.HostAliases {
+		if strings.EqualFold(alias, hostname) {
+			return p.Host
+		}
+	}
+	return hostname
+}
+
+// URL returns the HTTPS URL for the request,
+// see [hlfhr_utils.NewHttpsURL].
+//
+// If p.Port is empty, the port of the request is kept,
+// except that port 80 is omitted.
+//
+// If the host of the request is invalid, it returns [hlfhr_utils.ErrInvalidHost].
+func (p *RedirectPolicy) URL(r *http.Request) (string, error) {
+	return p.url(r, "")
+}
+
+// If p.Port is empty, defaultPort is used.
+// If both are empty, it's the port of the request, except 80.
+func (p *RedirectPolicy) url(r *http.Request, defaultPort string) (string, error) {
+	u, err := hlfhr_utils.NewHttpsURL(r)
+	if err != nil {
+		return "", err
+	}
+	u.Hostname = p.hostname(u.Hostname)
+	switch {
+	case p.Port != "":
+		u.Port = p.Port
+	case defaultPort != "":
+		u.Port = defaultPort
+	case u.Port == "80":
+		u.Port = ""
+	}
+	if p.DiscardPath {
+		u.EscapedPath = "/"
+	}
+	if p.DiscardQuery {
+		u.RawQuery = ""
+		u.ForceQuery = false
+	}
+	return u.String(), nil
+}
+
+// Redirect redirects the request to HTTPS without body,
+// such as in [Server.HlfhrHandler].
+//
+// If p.Port is empty, the port of the request is kept,
+// except that port 80 is omitted.
+//
+// If the host of the request is invalid, it responds 400.
+func (p *RedirectPolicy) Redirect(w http.ResponseWriter, r *http.Request) {
+	p.redirect(w, r, "")
+}
+
+func (p *RedirectPolicy) redirect(w http.ResponseWriter, r *http.Request, defaultPort string) {
+	url, err := p.url(r, defaultPort)
+	if err != nil {
+		// Error: invalid Host header
+		w.WriteHeader(400)
+		w.Write([]byte("invalid Host header"))
+		return
+	}
+	hlfhr_utils.Redirect(w, p.code(r.Method), url)
+}
+
+// Returns the redirect policy of the server.
+func (s *Server) redirectPolicy() *RedirectPolicy {
+	if s.RedirectPolicy != nil {
+		return s.RedirectPolicy
+	}
+	return defaultRedirectPolicy
+}
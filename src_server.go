@@ -1,14 +1,15 @@
 package hlfhr
 
 import (
+	"container/list"
 	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"strings"
-
-	"github.com/bddjr/shuttingdown"
+	"sync"
+	"time"
 )
 
 type Server struct {
@@ -16,7 +17,14 @@ type Server struct {
 
 	// Handles HTTP requests sent to an HTTPS server.
 	//
-	// If you need [http.Hijacker] or [http.ResponseController.EnableFullDuplex],
+	// The [http.ResponseWriter] implements [http.Hijacker].
+	// The request has RemoteAddr and the context like [http.Server],
+	// with ServerContextKey, LocalAddrContextKey, BaseContext and ConnContext.
+	// BaseContext is called once more for the TLS listener, and ConnContext is
+	// called again with the [*Conn] for the plain HTTP connections on the TLS
+	// port, after http.Server called it with the TLS connection.
+	// Hooks with side effects, such as counting connections, see them twice.
+	// If you need [http.ResponseController.EnableFullDuplex],
 	// please use https://github.com/bddjr/hahosp.
 	HlfhrHandler http.Handler
 
@@ -26,6 +34,231 @@ type Server struct {
 	//
 	// [Server.HlfhrHandler] is also using on port 80.
 	Listen80RedirectTo443 bool
+
+	// Decides how plain HTTP requests are redirected to HTTPS,
+	// if HlfhrHandler is nil.
+	//
+	// If nil, it redirects to the same host and path with 307.
+	RedirectPolicy *RedirectPolicy
+
+	// Decide the protocol of connections on the TLS listener by the first bytes,
+	// checked in order. This allows serving other protocols on the same port,
+	// such as SSH.
+	//
+	// If no detector decided, [DefaultDetect] is used.
+	Detectors []Detector
+
+	// Strips and parses PROXY protocol v1/v2 headers on the TLS listener
+	// and the Listen80RedirectTo443 listener, such as from HAProxy or AWS NLB.
+	// The address in the header is used as RemoteAddr and LocalAddr.
+	//
+	// If enabled, connections without the header will be closed.
+	// The headers are read in background, before the connections are passed
+	// to [http.Server] or served by hlfhr, so a slow client does not block
+	// accepting the others.
+	ProxyProtocol bool
+
+	// The maximum duration for reading the PROXY protocol header.
+	//
+	// If zero, ReadHeaderTimeout is used.
+	// If ReadHeaderTimeout is zero, it's 10 seconds.
+	ProxyProtocolTimeout time.Duration
+
+	// Keep plain HTTP connections alive, reading requests in a loop,
+	// including pipelined requests.
+	//
+	// [http.Server.IdleTimeout] is used for waiting the next request.
+	HlfhrKeepAlive bool
+
+	// Max bytes of request body on plain HTTP.
+	// If the Content-Length is larger, it responds 413 without calling
+	// [Server.HlfhrHandler], otherwise the body reader returns an error
+	// after reading too many bytes.
+	//
+	// If zero, there is no limit.
+	HlfhrMaxBodyBytes int64
+
+	// The maximum duration for waiting the first byte of a connection
+	// on the Listen80RedirectTo443 listener.
+	// After that, the timeouts of [http.Server] are used,
+	// such as ReadHeaderTimeout, ReadTimeout, WriteTimeout and IdleTimeout.
+	//
+	// If zero, ReadHeaderTimeout is used.
+	// If ReadHeaderTimeout is zero, ReadTimeout is used.
+	HlfhrFirstByteTimeout time.Duration
+
+	// Max count of plain HTTP connections served concurrently,
+	// including the ones on the TLS listener.
+	// The connections over the limit are rejected, see HlfhrRejectCode.
+	//
+	// If zero, there is no limit.
+	HlfhrMaxConns int
+
+	// Max rate of plain HTTP connections per client IP, in connections
+	// per second, limited by a token bucket with HlfhrRateBurst.
+	// The connections over the limit are rejected, see HlfhrRejectCode.
+	//
+	// If zero, there is no limit.
+	HlfhrRateLimit float64
+
+	// Burst of HlfhrRateLimit. If less than 1, it's 1.
+	HlfhrRateBurst int
+
+	// Status code for the rejected plain HTTP connections, such as 429 or 503.
+	// The rejected connections are not reported to HlfhrConnState.
+	//
+	// If zero, they are closed without response.
+	HlfhrRejectCode int
+
+	// Called when a plain HTTP connection changes state, like [http.Server.ConnState].
+	// It's StateNew, StateActive, StateIdle, StateHijacked or StateClosed.
+	//
+	// The connections accepted by the TLS listener are reported after
+	// the plain HTTP detected, use [Conn.IsSamePort] to distinguish them
+	// from the Listen80RedirectTo443 listener.
+	HlfhrConnState func(c *Conn, state http.ConnState)
+
+	// Receives the events, such as errors of serving plain HTTP.
+	// See [NewLogLogger], [NewSlogLogger] and [NewRateLimitLogger].
+	//
+	// If nil, the messages are printed to [http.Server.ErrorLog],
+	// or the standard logger of package log.
+	Logger Logger
+
+	// Extra plain HTTP listeners, served like Listen80RedirectTo443.
+	// Each of them redirects to its HTTPS port.
+	//
+	// For example, listen on ":8080" and redirect to port 8443:
+	//
+	//	srv.ListenRedirects = []hlfhr.ListenRedirect{{Addr: ":8080", ToPort: "8443"}}
+	ListenRedirects []ListenRedirect
+
+	// Answers ACME HTTP-01 challenges on plain HTTP,
+	// before [Server.HlfhrHandler] or redirecting.
+	// The paths start with [ACMEChallengePath].
+	ACMEChallenge ACMEChallengeProvider
+
+	// Like ACMEChallenge, for the handlers like [autocert.Manager.HTTPHandler].
+	// The fallback handler responds 404.
+	//
+	// If both are set, ACMEChallenge is tried first.
+	//
+	// [autocert.Manager.HTTPHandler]: https://pkg.go.dev/golang.org/x/crypto/acme/autocert#Manager.HTTPHandler
+	ACMEHTTPHandler func(fallback http.Handler) http.Handler
+
+	// Obtains and renews certificates automatically, such as [autocert.Manager].
+	// If set, it's used as GetCertificate of the TLS config,
+	// the certFile and keyFile can be empty,
+	// and it also answers ACME HTTP-01 challenges like ACMEHTTPHandler.
+	//
+	// HTTP-01 challenges are sent to port 80,
+	// use it with Listen80RedirectTo443 or ListenRedirects.
+	//
+	// If TLSConfig.GetCertificate is also set,
+	// it's called when CertManager returns an error.
+	// Then the certFile and keyFile, KeyPairs and KeyPairsDir are used.
+	//
+	// [autocert.Manager]: https://pkg.go.dev/golang.org/x/crypto/acme/autocert#Manager
+	CertManager CertManager
+
+	// More certificates, selected by the server name (SNI) of TLS handshakes,
+	// matching wildcard names like "*.example.com".
+	//
+	// The default certificate is the certFile and keyFile passed to
+	// ServeTLS or ListenAndServeTLS, or the first one of KeyPairs,
+	// or the first one in KeyPairsDir.
+	//
+	// With CertManager, they are used when CertManager
+	// and TLSConfig.GetCertificate return an error.
+	KeyPairs []KeyPair
+
+	// Directory containing certificates like KeyPairs,
+	// such as "example.com.crt" and "example.com.key".
+	KeyPairsDir string
+
+	// Polls the certificate files, such as the certFile and keyFile passed to
+	// ServeTLS or ListenAndServeTLS, in this interval,
+	// reloads the certificates when they change.
+	// Invalid files are logged, the old certificate stays in use.
+	// See also [Server.ReloadCertificate].
+	//
+	// If zero, it does not poll.
+	CertReloadInterval time.Duration
+
+	// Generates a certificate for development, if no certificate is provided:
+	// the certFile and keyFile are empty, and TLSConfig, KeyPairs and
+	// KeyPairsDir have no certificate.
+	//
+	// Do not use it in production.
+	DevCert *DevCert
+
+	// Adds the Strict-Transport-Security header to HTTPS responses,
+	// so that browsers use HTTPS directly next time.
+	// It's never added to plain HTTP responses.
+	//
+	// ServeTLS replaces [http.Server.Handler] with a wrapper adding it
+	// before serving, the handler does not need to change.
+	// The wrapper calls the original handler, and it's restored
+	// after [Server.Shutdown] completed or [Server.Close].
+	// If ServeTLS returns another error, such as from Accept,
+	// its connections may still be served, so it's kept until then.
+	// Do not reassign Handler while serving, the wrapper would be lost.
+	HSTS *HSTS
+
+	// Hostnames allowed in the Host header of plain HTTP requests,
+	// such as "example.com", "*.example.com" or "127.0.0.1".
+	// "*.example.com" matches all subdomains of "example.com".
+	//
+	// Requests for other hosts get UnknownHostCode and are logged,
+	// without redirecting, answering ACME challenges or calling HlfhrHandler.
+	// This avoids redirecting to the hosts you do not own,
+	// such as DNS rebinding.
+	//
+	// If empty, all hosts are allowed.
+	AllowedHosts []string
+
+	// Also check AllowedHosts for HTTPS requests.
+	// ServeTLS replaces [http.Server.Handler] with a wrapper to check it,
+	// like HSTS.
+	AllowedHostsTLS bool
+
+	// Status code for the hosts not in AllowedHosts, such as 400.
+	//
+	// If zero, it's 421 Misdirected Request.
+	UnknownHostCode int
+
+	inShutdown int32 // accessed atomically
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	conns      map[*Conn]struct{}
+
+	certReloaders map[*certReloader]struct{}
+
+	certManagerOnce    sync.Once
+	certManagerHandler http.Handler
+
+	// Guarded by mu
+	hlfhrConns     int
+	rejectingConns int
+	rateBuckets    map[string]*list.Element
+	rateLRU        list.List
+
+	statsMu sync.Mutex
+	stats   Stats
+}
+
+// A plain HTTP listener served like Listen80RedirectTo443.
+type ListenRedirect struct {
+	// Network such as "tcp".
+	// If empty, the network of the TLS listener is used.
+	Network string
+
+	// Address to listen on, such as ":8080".
+	Addr string
+
+	// HTTPS port of the redirect target, such as "8443".
+	// If empty, the port of the TLS listener is used.
+	ToPort string
 }
 
 // New hlfhr Server
@@ -47,13 +280,17 @@ func NewServer(s *http.Server) *Server {
 //
 // Files containing a certificate and matching private key for the
 // server must be provided if neither the [Server]'s
-// TLSConfig.Certificates nor TLSConfig.GetCertificate are populated.
+// TLSConfig.Certificates, TLSConfig.GetCertificate, KeyPairs
+// nor KeyPairsDir are populated.
 // If the certificate is signed by a certificate authority, the
 // certFile should be the concatenation of the server's certificate,
 // any intermediates, and the CA's certificate.
+// The certFile and keyFile, or KeyPairs, replace TLSConfig.Certificates.
 //
 // If Listen80RedirectTo443 failed, the returned error is starts with
 // "hlfhr: Listen80RedirectTo443 error: ".
+// If ListenRedirects failed, the returned error is starts with
+// "hlfhr: ListenRedirects error: ".
 //
 // After [Server.Shutdown] or [Server.Close], the
 // returned error is [http.ErrServerClosed].
@@ -61,6 +298,9 @@ func (s *Server) ServeTLS(l net.Listener, certFile string, keyFile string) error
 	if s.Server == nil {
 		s.Server = new(http.Server)
 	}
+	if s.shuttingDown() {
+		return http.ErrServerClosed
+	}
 
 	// Setup HTTP/2
 	if s.TLSConfig == nil {
@@ -73,14 +313,44 @@ func (s *Server) ServeTLS(l net.Listener, certFile string, keyFile string) error
 	// clone tls config
 	config := s.TLSConfig.Clone()
 
+	if s.CertManager != nil {
+		s.setupCertManager(config)
+	}
+
 	configHasCert := len(config.Certificates) > 0 || config.GetCertificate != nil || config.GetConfigForClient != nil
-	if !configHasCert || certFile != "" || keyFile != "" {
-		var err error
-		config.Certificates = make([]tls.Certificate, 1)
-		config.Certificates[0], err = tls.LoadX509KeyPair(certFile, keyFile)
+	var pairs []KeyPair
+	if certFile != "" || keyFile != "" {
+		pairs = append(pairs, KeyPair{CertFile: certFile, KeyFile: keyFile})
+	} else if !configHasCert && len(s.KeyPairs) == 0 && s.KeyPairsDir == "" {
+		if s.DevCert != nil {
+			certPEM, keyPEM, err := s.DevCert.generate()
+			if err != nil {
+				return err
+			}
+			pairs = append(pairs, KeyPair{CertPEM: certPEM, KeyPEM: keyPEM})
+		} else {
+			pairs = append(pairs, KeyPair{})
+		}
+	}
+	pairs = append(pairs, s.KeyPairs...)
+	if len(pairs) != 0 {
+		// Replaced like http.Server, crypto/tls skips GetCertificate
+		// for the clients without SNI if Certificates is not empty.
+		config.Certificates = nil
+	}
+	if len(pairs) != 0 || s.KeyPairsDir != "" {
+		r, err := newCertReloader(s, pairs, s.KeyPairsDir)
 		if err != nil {
 			return err
 		}
+		config.GetCertificate = r.getCertificateFunc(config.GetCertificate)
+		s.trackCertReloader(r, true)
+		defer s.trackCertReloader(r, false)
+		if d := s.CertReloadInterval; d > 0 {
+			done := make(chan struct{})
+			defer close(done)
+			go r.poll(d, done)
+		}
 	}
 
 	// listen 80
@@ -97,23 +367,34 @@ func (s *Server) ServeTLS(l net.Listener, certFile string, keyFile string) error
 				return fmt.Errorf("hlfhr: Listen80RedirectTo443 error: net.Listen: %v", err)
 			}
 			defer l80.Close()
-			go func() {
-				for {
-					c, err := l80.Accept()
-					if err != nil {
-						return
-					}
-					go func(c net.Conn) {
-						defer c.Close()
-						(&Conn{
-							Conn:    c,
-							TLSConn: nil,
-							Server:  s,
-						}).HlfhrServe(nil, 0)
-					}(c)
-				}
-			}()
+			go s.servePlain(l80, "443")
+		}
+	}
+
+	// listen redirects
+	for _, lr := range s.ListenRedirects {
+		network := lr.Network
+		if network == "" {
+			network = l.Addr().Network()
+		}
+		toPort := lr.ToPort
+		if toPort == "" {
+			_, port, err := net.SplitHostPort(l.Addr().String())
+			if err != nil {
+				return fmt.Errorf("hlfhr: ListenRedirects error: net.SplitHostPort: %v", err)
+			}
+			toPort = port
+		}
+		lp, err := net.Listen(network, lr.Addr)
+		if err != nil {
+			return fmt.Errorf("hlfhr: ListenRedirects error: net.Listen: %v", err)
 		}
+		defer lp.Close()
+		go s.servePlain(lp, toPort)
+	}
+
+	if s.HSTS != nil || s.AllowedHostsTLS {
+		s.setupTLSHandler()
 	}
 
 	// serve
@@ -158,13 +439,15 @@ func ServeTLS(l net.Listener, handler http.Handler, certFile, keyFile string) er
 //
 // If Listen80RedirectTo443 failed, the returned error is starts with
 // "hlfhr: Listen80RedirectTo443 error: ".
+// If ListenRedirects failed, the returned error is starts with
+// "hlfhr: ListenRedirects error: ".
 //
 // After [Server.Shutdown] or
 // [Server.Close], the returned error is [http.ErrServerClosed].
 func (s *Server) ListenAndServeTLS(certFile string, keyFile string) error {
 	if s.Server == nil {
 		s.Server = new(http.Server)
-	} else if shuttingdown.IsShuttingDown(s.Server) {
+	} else if s.shuttingDown() {
 		return http.ErrServerClosed
 	}
 	addr := s.Addr
@@ -196,6 +479,99 @@ func ListenAndServeTLS(addr, certFile, keyFile string, handler http.Handler) err
 	}).ListenAndServeTLS(certFile, keyFile)
 }
 
+// ServeHTTPRedirect accepts plain HTTP connections on the listener l,
+// serves them like Listen80RedirectTo443, such as [Server.HlfhrHandler],
+// or redirecting to HTTPS.
+// It's useful for the listeners created by the caller,
+// such as systemd sockets or unix sockets.
+//
+// The requests are redirected to the port of [http.Server.Addr],
+// or port 443 if it's not specified.
+//
+// ServeHTTPRedirect always returns a non-nil error and closes l.
+// After [Server.Shutdown] or [Server.Close], the returned error is [http.ErrServerClosed].
+func (s *Server) ServeHTTPRedirect(l net.Listener) error {
+	if s.Server == nil {
+		s.Server = new(http.Server)
+	}
+	toPort := "443"
+	if _, port, err := net.SplitHostPort(s.Addr); err == nil && port != "" && port != "https" {
+		toPort = port
+	}
+	return s.servePlain(l, toPort)
+}
+
+// Accepts plain HTTP connections on l, serves them by [Conn.HlfhrServe].
+// The requests are redirected to the HTTPS port toPort.
+func (s *Server) servePlain(l net.Listener, toPort string) error {
+	defer l.Close()
+	if !s.trackListener(l, true) {
+		return http.ErrServerClosed
+	}
+	defer s.trackListener(l, false)
+
+	baseCtx := s.baseContext(l)
+	ln := l
+	if s.ProxyProtocol {
+		ln = newProxyProtocolListener(l, s)
+	}
+	var tempDelay time.Duration // how long to sleep on accept failure
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if s.shuttingDown() {
+				return http.ErrServerClosed
+			}
+			if s.retryAccept(l, err, &tempDelay) {
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+		s.count(func(st *Stats) { st.PlainListenerConns++ })
+		hc := &Conn{
+			Conn:         c,
+			TLSConn:      nil,
+			Server:       s,
+			redirectPort: toPort,
+			baseCtx:      baseCtx,
+		}
+		if !hc.acquire() {
+			s.rejectPlain(hc)
+			continue
+		}
+		hc.setState(http.StateNew)
+		go func() {
+			defer hc.Close()
+			hc.HlfhrServe(nil, 0)
+		}()
+	}
+}
+
+// Sleeps and reports true if err is temporary, like [http.Server.Serve].
+func (s *Server) retryAccept(l net.Listener, err error, tempDelay *time.Duration) bool {
+	ne, ok := err.(net.Error)
+	if !ok || !ne.Temporary() {
+		return false
+	}
+	if *tempDelay == 0 {
+		*tempDelay = 5 * time.Millisecond
+	} else {
+		*tempDelay *= 2
+	}
+	if max := 1 * time.Second; *tempDelay > max {
+		*tempDelay = max
+	}
+	s.logEvent(&Event{
+		Kind:     EventListenerError,
+		Listener: addrString(l.Addr()),
+		Err:      err,
+		Message:  fmt.Sprintf("hlfhr: Accept error: %v; retrying in %v", err, *tempDelay),
+	})
+	time.Sleep(*tempDelay)
+	return true
+}
+
 func (s *Server) logf(format string, v ...interface{}) {
 	if s.ErrorLog != nil {
 		s.ErrorLog.Printf(format, v...)
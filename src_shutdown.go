@@ -0,0 +1,150 @@
+package hlfhr
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/bddjr/shuttingdown"
+)
+
+const shutdownPollIntervalMax = 500 * time.Millisecond
+
+// Like http.Server, a new connection is closed by Shutdown as idle
+// if no request is read for a while after it's accepted.
+const newConnIdleTimeout = 5 * time.Second
+
+// Shutdown gracefully shuts down the server without interrupting any
+// active connections, including the plain HTTP connections served by hlfhr.
+//
+// It closes the Listen80RedirectTo443 listener immediately, then calls
+// [http.Server.Shutdown], which runs the [http.Server.RegisterOnShutdown]
+// hooks. Then it closes the idle plain HTTP connections, and waits for
+// the active ones, such as calls to [Server.HlfhrHandler].
+// Like [http.Server.Shutdown], the new connections without a request
+// are treated as idle after 5 seconds.
+//
+// If the provided context expires before the shutdown is complete,
+// Shutdown returns the context's error, otherwise it returns any error
+// returned from closing the listeners.
+//
+// Hijacked connections are not tracked.
+func (s *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.inShutdown, 1)
+
+	s.mu.Lock()
+	lnerr := s.closeListenersLocked()
+	s.mu.Unlock()
+	s.closeIdleConns()
+
+	if s.Server != nil {
+		if err := s.Server.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+
+	pollIntervalBase := time.Millisecond
+	nextPollInterval := func() time.Duration {
+		// Add 10% jitter.
+		interval := pollIntervalBase + time.Duration(time.Now().UnixNano()%int64(pollIntervalBase/10+1))
+		// Double and clamp for next time.
+		pollIntervalBase *= 2
+		if pollIntervalBase > shutdownPollIntervalMax {
+			pollIntervalBase = shutdownPollIntervalMax
+		}
+		return interval
+	}
+
+	timer := time.NewTimer(nextPollInterval())
+	defer timer.Stop()
+	for {
+		if s.closeIdleConns() {
+			if s.Server != nil {
+				s.restoreTLSHandler()
+			}
+			return lnerr
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			timer.Reset(nextPollInterval())
+		}
+	}
+}
+
+// Close immediately closes all listeners and connections,
+// including the plain HTTP connections served by hlfhr.
+//
+// Close returns any error returned from closing the listeners.
+//
+// Hijacked connections are not tracked.
+func (s *Server) Close() error {
+	atomic.StoreInt32(&s.inShutdown, 1)
+
+	s.mu.Lock()
+	err := s.closeListenersLocked()
+	for c := range s.conns {
+		c.Conn.Close()
+	}
+	s.mu.Unlock()
+
+	if s.Server != nil {
+		if err2 := s.Server.Close(); err == nil {
+			err = err2
+		}
+		s.restoreTLSHandler()
+	}
+	return err
+}
+
+func (s *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&s.inShutdown) != 0 ||
+		(s.Server != nil && shuttingdown.IsShuttingDown(s.Server))
+}
+
+// Closes the idle plain HTTP connections,
+// reports whether there is no active connection.
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for c := range s.conns {
+		if c.state == http.StateIdle ||
+			(c.state == http.StateNew && now.Sub(c.stateTime) >= newConnIdleTimeout) {
+			c.Conn.Close()
+		}
+	}
+	return len(s.conns) == 0
+}
+
+func (s *Server) closeListenersLocked() error {
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	s.listeners = nil
+	return err
+}
+
+// Tracks the plain HTTP listener, reports false if shutting down.
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.shuttingDown() {
+			return false
+		}
+		if s.listeners == nil {
+			s.listeners = make(map[net.Listener]struct{})
+		}
+		s.listeners[l] = struct{}{}
+	} else {
+		delete(s.listeners, l)
+	}
+	return true
+}
@@ -0,0 +1,142 @@
+package hlfhr
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Stats is a snapshot of the counters of [Server], see [Server.Stats].
+type Stats struct {
+	// Connections on the TLS listener continuing the TLS handshake.
+	TLSConns uint64
+
+	// Plain HTTP connections detected on the TLS listener.
+	SamePortHTTPConns uint64
+
+	// Connections accepted by the plain HTTP listeners,
+	// such as Listen80RedirectTo443, ListenRedirects and ServeHTTPRedirect.
+	PlainListenerConns uint64
+
+	// Connections detected as [ProtocolOther] by [Server.Detectors].
+	OtherProtocolConns uint64
+
+	// Plain HTTP connections rejected by [Server.HlfhrMaxConns].
+	MaxConnsRejected uint64
+
+	// Plain HTTP connections rejected by [Server.HlfhrRateLimit].
+	RateLimitRejected uint64
+
+	// Plain HTTP redirects by status code.
+	Redirects map[int]uint64
+
+	// Calls to [Server.HlfhrHandler].
+	HlfhrHandlerCalls uint64
+
+	// Requests rejected by [Server.AllowedHosts].
+	UnknownHosts uint64
+
+	// Errors of reading plain HTTP requests.
+	ReadRequestErrors uint64
+
+	// Errors of writing plain HTTP responses.
+	WriteErrors uint64
+
+	// Recovered panics of serving plain HTTP or other protocols.
+	Panics uint64
+}
+
+// Stats returns a snapshot of the counters.
+func (s *Server) Stats() Stats {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	st := s.stats
+	st.Redirects = make(map[int]uint64, len(s.stats.Redirects))
+	for code, n := range s.stats.Redirects {
+		st.Redirects[code] = n
+	}
+	return st
+}
+
+// Updates the counters.
+func (s *Server) count(f func(st *Stats)) {
+	s.statsMu.Lock()
+	f(&s.stats)
+	s.statsMu.Unlock()
+}
+
+func (s *Server) countRedirect(code int) {
+	if code < 300 || code > 399 {
+		// Such as invalid Host header
+		return
+	}
+	s.count(func(st *Stats) {
+		if st.Redirects == nil {
+			st.Redirects = make(map[int]uint64)
+		}
+		st.Redirects[code]++
+	})
+}
+
+// MetricsHandler returns a handler writing the counters
+// in Prometheus text format, such as for "/metrics".
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		st := s.Stats()
+		w.Write([]byte(st.prometheusText()))
+	})
+}
+
+func (st *Stats) prometheusText() string {
+	var b strings.Builder
+	metric := func(name, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	}
+
+	metric("hlfhr_connections_total", "Connections by detected protocol.")
+	fmt.Fprintf(&b, "hlfhr_connections_total{type=\"tls\"} %d\n", st.TLSConns)
+	fmt.Fprintf(&b, "hlfhr_connections_total{type=\"same_port_http\"} %d\n", st.SamePortHTTPConns)
+	fmt.Fprintf(&b, "hlfhr_connections_total{type=\"plain_listener\"} %d\n", st.PlainListenerConns)
+	fmt.Fprintf(&b, "hlfhr_connections_total{type=\"other\"} %d\n", st.OtherProtocolConns)
+
+	metric("hlfhr_rejected_connections_total", "Plain HTTP connections rejected by reason.")
+	fmt.Fprintf(&b, "hlfhr_rejected_connections_total{reason=\"max_conns\"} %d\n", st.MaxConnsRejected)
+	fmt.Fprintf(&b, "hlfhr_rejected_connections_total{reason=\"rate_limit\"} %d\n", st.RateLimitRejected)
+
+	metric("hlfhr_redirects_total", "Plain HTTP redirects by status code.")
+	codes := make([]int, 0, len(st.Redirects))
+	for code := range st.Redirects {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(&b, "hlfhr_redirects_total{code=\"%d\"} %d\n", code, st.Redirects[code])
+	}
+
+	metric("hlfhr_handler_calls_total", "Calls to HlfhrHandler.")
+	fmt.Fprintf(&b, "hlfhr_handler_calls_total %d\n", st.HlfhrHandlerCalls)
+
+	metric("hlfhr_unknown_hosts_total", "Requests rejected by AllowedHosts.")
+	fmt.Fprintf(&b, "hlfhr_unknown_hosts_total %d\n", st.UnknownHosts)
+
+	metric("hlfhr_errors_total", "Errors of serving plain HTTP by type.")
+	fmt.Fprintf(&b, "hlfhr_errors_total{type=\"read_request\"} %d\n", st.ReadRequestErrors)
+	fmt.Fprintf(&b, "hlfhr_errors_total{type=\"write\"} %d\n", st.WriteErrors)
+	fmt.Fprintf(&b, "hlfhr_errors_total{type=\"panic\"} %d\n", st.Panics)
+	return b.String()
+}
+
+// StatsFunc returns a function returning [Server.Stats],
+// for publishing the counters with [expvar.Func], such as:
+//
+//	expvar.Publish("hlfhr", expvar.Func(srv.StatsFunc()))
+//
+// The package does not import expvar,
+// which registers "/debug/vars" on [http.DefaultServeMux].
+func (s *Server) StatsFunc() func() interface{} {
+	return func() interface{} {
+		return s.Stats()
+	}
+}
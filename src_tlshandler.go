@@ -0,0 +1,75 @@
+package hlfhr
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// HSTS is the Strict-Transport-Security header for HTTPS responses,
+// see [Server.HSTS].
+type HSTS struct {
+	// How long browsers should only use HTTPS, rounded down to seconds.
+	MaxAge time.Duration
+
+	IncludeSubDomains bool
+
+	// Submitting to the preload list requires
+	// MaxAge of at least 1 year and IncludeSubDomains.
+	Preload bool
+}
+
+// Returns the header value, such as "max-age=31536000; includeSubDomains".
+func (h *HSTS) String() string {
+	v := "max-age=" + strconv.FormatInt(int64(h.MaxAge/time.Second), 10)
+	if h.IncludeSubDomains {
+		v += "; includeSubDomains"
+	}
+	if h.Preload {
+		v += "; preload"
+	}
+	return v
+}
+
+// Wraps [http.Server.Handler] for HTTPS requests,
+// adds the HSTS header and checks AllowedHosts.
+type tlsHandler struct {
+	s *Server
+	h http.Handler
+}
+
+func (h *tlsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.TLS != nil {
+		if hsts := h.s.HSTS; hsts != nil {
+			w.Header().Set("Strict-Transport-Security", hsts.String())
+		}
+		if h.s.AllowedHostsTLS && h.s.rejectUnknownHost(w, r) {
+			return
+		}
+	}
+	handler := h.h
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	handler.ServeHTTP(w, r)
+}
+
+// Wraps [http.Server.Handler] by tlsHandler once,
+// before serving, so that concurrent ServeTLS calls do not write it again.
+func (s *Server) setupTLSHandler() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h, ok := s.Handler.(*tlsHandler); !ok || h.s != s {
+		s.Handler = &tlsHandler{s: s, h: s.Handler}
+	}
+}
+
+// Restores [http.Server.Handler] wrapped by setupTLSHandler,
+// after the connections are closed.
+func (s *Server) restoreTLSHandler() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h, ok := s.Handler.(*tlsHandler); ok && h.s == s {
+		s.Handler = h.h
+	}
+}
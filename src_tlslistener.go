@@ -1,26 +1,46 @@
 package hlfhr
 
 import (
+	"context"
 	"crypto/tls"
 	"net"
+	"sync"
 )
 
 type TLSListener struct {
 	net.Listener
 	TLSConf *tls.Config
 	Server  *Server
+
+	baseCtxOnce sync.Once
+	baseCtx     context.Context
+
+	proxyOnce     sync.Once
+	proxyListener net.Listener
 }
 
 func (l *TLSListener) Accept() (net.Conn, error) {
-	c, err := l.Listener.Accept()
+	ln := l.Listener
+	if l.Server.ProxyProtocol {
+		l.proxyOnce.Do(func() {
+			l.proxyListener = newProxyProtocolListener(l.Listener, l.Server)
+		})
+		ln = l.proxyListener
+	}
+	c, err := ln.Accept()
 	if err != nil {
 		return nil, err
 	}
 
+	l.baseCtxOnce.Do(func() {
+		l.baseCtx = l.Server.baseContext(l)
+	})
+
 	mc := &Conn{
 		Conn:    c,
 		TLSConn: nil,
 		Server:  l.Server,
+		baseCtx: l.baseCtx,
 	}
 	mc.TLSConn = tls.Server(mc, l.TLSConf)
 	return mc.TLSConn, nil
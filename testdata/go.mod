@@ -6,4 +6,7 @@ replace github.com/bddjr/hlfhr => ../
 
 require github.com/bddjr/hlfhr v0.0.0
 
-require golang.org/x/net v0.0.0-20210423184538-5f58ad60dda6
+require (
+	golang.org/x/crypto v0.0.0-20210421170649-83a5a9bb288b
+	golang.org/x/net v0.0.0-20210423184538-5f58ad60dda6
+)
@@ -47,7 +47,8 @@ func main() {
 		}),
 	})
 	srv.Listen80RedirectTo443 = true
-	err := srv.ListenAndServeTLS("invalid.crt", "invalid.key")
+	srv.DevCert = &hlfhr.DevCert{}
+	err := srv.ListenAndServeTLS("", "")
 	if err != nil {
 		panic(err)
 	}
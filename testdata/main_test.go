@@ -3,17 +3,34 @@ package main_test
 import (
 	"bufio"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"expvar"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/bddjr/hlfhr"
+	hlfhr_lib "github.com/bddjr/hlfhr/lib"
 	"golang.org/x/net/http2"
 )
 
@@ -36,6 +53,84 @@ func readAll(r io.Reader) ([]byte, error) {
 	}
 }
 
+// Listens on a random port of 127.0.0.1.
+func listen() net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	return l
+}
+
+// Returns n free addresses of 127.0.0.1, for the listeners created by hlfhr.
+func freeAddrs(n int) []string {
+	addrs := make([]string, n)
+	for i := range addrs {
+		l := listen()
+		defer l.Close()
+		addrs[i] = l.Addr().String()
+	}
+	return addrs
+}
+
+// Polls until cond reports true, panics after one second.
+func waitFor(cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			panic("timeout")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Waits until addr accepts connections.
+func waitListening(addr string) {
+	waitFor(func() bool {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			return false
+		}
+		c.Close()
+		return true
+	})
+}
+
+// Dials addr, with a deadline of one second.
+func dial(addr string) net.Conn {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		panic(err)
+	}
+	c.SetDeadline(time.Now().Add(time.Second))
+	return c
+}
+
+// Writes raw to c, then reads the response and its body within one second.
+func roundTrip(c net.Conn, raw string) (*http.Response, []byte) {
+	c.SetDeadline(time.Now().Add(time.Second))
+	_, err := io.WriteString(c, raw)
+	if err != nil {
+		panic(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		panic(err)
+	}
+	b, err := readAll(resp.Body)
+	if err != nil {
+		panic(err)
+	}
+	return resp, b
+}
+
+// Sends raw on a new connection to addr, see roundTrip.
+func rawRequest(addr, raw string) (*http.Response, []byte) {
+	c := dial(addr)
+	defer c.Close()
+	return roundTrip(c, raw)
+}
+
 func tlsVersionName(version uint16) string {
 	switch version {
 	case 0x0301:
@@ -127,14 +222,7 @@ func request(serverAddr string) {
 	// Missing "Host" header
 	{
 		println("Test missing \"Host\" header")
-		_, err = io.WriteString(c, "GET / HTTP/1.0\r\n\r\n")
-		if err != nil {
-			panic(err)
-		}
-		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
-		if err != nil {
-			panic(err)
-		}
+		resp, _ := roundTrip(c, "GET / HTTP/1.0\r\n\r\n")
 		if resp.StatusCode != 400 {
 			panic(resp.StatusCode)
 		}
@@ -182,6 +270,228 @@ func requestTestHlfhrHandler(serverAddr string) {
 	println()
 }
 
+func requestTestDetector(serverAddr string) {
+	println("requestTestDetector")
+	c := dial(serverAddr)
+	defer c.Close()
+
+	// Short first segment, the prefix should still be detected.
+	_, err := io.WriteString(c, "SS")
+	if err != nil {
+		panic(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	_, err = io.WriteString(c, "H-2.0-test\r\n")
+	if err != nil {
+		panic(err)
+	}
+	b, err := readAll(c)
+	if err != nil {
+		panic(err)
+	}
+	if string(b) != "SSH-2.0-test\r\n" {
+		panic(string(b))
+	}
+	println()
+}
+
+func requestTestKeepAlive(serverAddr string) {
+	println("requestTestKeepAlive")
+	c := dial(serverAddr)
+	defer c.Close()
+
+	// Pipelined
+	_, err := io.WriteString(c, "GET /1 HTTP/1.1\r\nHost: localhost\r\n\r\nGET /2 HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if err != nil {
+		panic(err)
+	}
+	br := bufio.NewReader(c)
+	for i := 0; i < 3; i++ {
+		if i == 2 {
+			_, err = io.WriteString(c, "GET /3 HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+			if err != nil {
+				panic(err)
+			}
+		}
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			panic(err)
+		}
+		b, err := readAll(resp.Body)
+		if err != nil {
+			panic(err)
+		}
+		print(string(b))
+		if resp.Close != (i == 2) {
+			panic(i)
+		}
+	}
+	if b, _ := readAll(br); len(b) != 0 {
+		panic(string(b))
+	}
+	println()
+}
+
+func requestTestHijack(serverAddr string) {
+	println("requestTestHijack")
+	c := dial(serverAddr)
+	defer c.Close()
+
+	_, err := io.WriteString(c, "GET /hijack HTTP/1.1\r\nHost: localhost\r\n\r\nping")
+	if err != nil {
+		panic(err)
+	}
+	b, err := readAll(c)
+	if err != nil {
+		panic(err)
+	}
+	if string(b) != "HTTP/1.1 101 Switching Protocols\r\n\r\nping" {
+		panic(string(b))
+	}
+	println()
+}
+
+func requestTestStream(serverAddr string) {
+	println("requestTestStream")
+	resp, b := rawRequest(serverAddr, "GET /stream HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if len(resp.TransferEncoding) != 1 || resp.TransferEncoding[0] != "chunked" {
+		panic(resp.TransferEncoding)
+	}
+	if len(b) != 10<<10 {
+		panic(len(b))
+	}
+	if v := resp.Trailer.Get("X-Length"); v != "10240" {
+		panic(v)
+	}
+	println()
+}
+
+func requestTestNoBody(serverAddr string) {
+	println("requestTestNoBody")
+	c := dial(serverAddr)
+	defer c.Close()
+
+	_, err := io.WriteString(c, "HEAD /stream HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+		"GET /204 HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+		"GET /204 HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	if err != nil {
+		panic(err)
+	}
+	br := bufio.NewReader(c)
+	for _, method := range []string{"HEAD", "GET", "GET"} {
+		resp, err := http.ReadResponse(br, &http.Request{Method: method})
+		if err != nil {
+			panic(err)
+		}
+		if len(resp.TransferEncoding) != 0 {
+			panic(resp.TransferEncoding)
+		}
+		resp.Body.Close()
+	}
+	if b, _ := readAll(br); len(b) != 0 {
+		panic(string(b))
+	}
+	println()
+}
+
+func requestTestInformational(serverAddr string) {
+	println("requestTestInformational")
+	c := dial(serverAddr)
+	defer c.Close()
+	br := bufio.NewReader(c)
+
+	// 103 Early Hints, a separate status line before the final response.
+	_, err := io.WriteString(c, "GET /103 HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if err != nil {
+		panic(err)
+	}
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		panic(err)
+	}
+	if resp.StatusCode != 103 || resp.Header.Get("Link") != "</a.css>; rel=preload" {
+		panic(fmt.Sprint(resp.Status, resp.Header))
+	}
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		panic(err)
+	}
+	b, err := readAll(resp.Body)
+	if err != nil {
+		panic(err)
+	}
+	if resp.StatusCode != 200 || string(b) != "ok" {
+		panic(fmt.Sprint(resp.Status, string(b)))
+	}
+
+	// 100 Continue, sent on the first read of the body.
+	_, err = io.WriteString(c, "POST /continue HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 4\r\n\r\n")
+	if err != nil {
+		panic(err)
+	}
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		panic(err)
+	}
+	if resp.StatusCode != 100 {
+		panic(resp.Status)
+	}
+	_, err = io.WriteString(c, "ping")
+	if err != nil {
+		panic(err)
+	}
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		panic(err)
+	}
+	b, err = readAll(resp.Body)
+	if err != nil {
+		panic(err)
+	}
+	if resp.StatusCode != 200 || string(b) != "ping" {
+		panic(fmt.Sprint(resp.Status, string(b)))
+	}
+
+	// 304 keeps the Content-Length of the handler without a body,
+	// the next response is framed correctly.
+	_, err = io.WriteString(c, "GET /304 HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+		"GET /204 HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	if err != nil {
+		panic(err)
+	}
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		panic(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 304 || resp.Header.Get("Content-Length") != "10" {
+		panic(fmt.Sprint(resp.Status, resp.Header))
+	}
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		panic(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 204 {
+		panic(resp.Status)
+	}
+	if b, _ := readAll(br); len(b) != 0 {
+		panic(string(b))
+	}
+	println()
+}
+
+func requestTestBodyLimit(serverAddr string) {
+	println("requestTestBodyLimit")
+	// Still uploading
+	resp, _ := rawRequest(serverAddr, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 65536\r\n\r\n"+
+		strings.Repeat("\x00", 32<<10))
+	if resp.StatusCode != 413 {
+		panic(resp.StatusCode)
+	}
+	println()
+}
+
 func test1(serverAddr string) {
 	println()
 
@@ -214,26 +524,108 @@ func test1(serverAddr string) {
 		}),
 	})
 	srv.Listen80RedirectTo443 = true
+	var connStateMu sync.Mutex
+	connStates := map[http.ConnState]int{}
+	srv.HlfhrConnState = func(c *hlfhr.Conn, state http.ConnState) {
+		connStateMu.Lock()
+		connStates[state]++
+		connStateMu.Unlock()
+	}
+	srv.Detectors = []hlfhr.Detector{&hlfhr.PrefixDetector{
+		Prefix: []byte("SSH-"),
+		Handler: hlfhr.ConnHandlerFunc(func(c net.Conn) {
+			// Echo the first line
+			line, err := bufio.NewReader(c).ReadString('\n')
+			if err != nil {
+				panic(err)
+			}
+			io.WriteString(c, line)
+		}),
+	}}
 
 	println("Listen " + serverAddr)
 
-	var err error
+	serveErr := make(chan error, 1)
 	go func() {
-		err = srv.ListenAndServeTLS("invalid.crt", "invalid.key")
+		serveErr <- srv.ListenAndServeTLS("invalid.crt", "invalid.key")
 	}()
-	time.Sleep(100 * time.Millisecond)
-	if err != nil {
-		panic(err)
-	}
+	waitListening(serverAddr)
 	println()
 
 	request(serverAddr)
+	requestTestDetector(serverAddr)
 	if addr := strings.TrimSuffix(serverAddr, ":443"); addr != serverAddr {
 		addr += ":80"
+		waitListening(addr)
 		request(addr)
 	}
 
+	slowStarted := make(chan struct{})
 	srv.HlfhrHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stream" {
+			w.Header().Set("Trailer", "X-Length")
+			w.WriteHeader(200)
+			w.Write(make([]byte, 1024))
+			w.(http.Flusher).Flush()
+			w.Write(make([]byte, 9<<10))
+			w.Header().Set("X-Length", "10240")
+			return
+		}
+		if r.URL.Path == "/slow" {
+			close(slowStarted)
+			time.Sleep(200 * time.Millisecond)
+			w.WriteHeader(200)
+			return
+		}
+		if r.URL.Path == "/204" {
+			w.WriteHeader(204)
+			if _, err := io.WriteString(w, "body"); err != http.ErrBodyNotAllowed {
+				panic(err)
+			}
+			return
+		}
+		if r.URL.Path == "/103" {
+			w.Header().Set("Link", "</a.css>; rel=preload")
+			w.WriteHeader(103)
+			w.WriteHeader(200)
+			io.WriteString(w, "ok")
+			return
+		}
+		if r.URL.Path == "/304" {
+			w.Header().Set("Content-Length", "10")
+			w.WriteHeader(304)
+			if _, err := io.WriteString(w, "body"); err != http.ErrBodyNotAllowed {
+				panic(err)
+			}
+			return
+		}
+		if r.URL.Path == "/continue" {
+			b, err := readAll(r.Body)
+			if err != nil {
+				panic(err)
+			}
+			w.WriteHeader(200)
+			w.Write(b)
+			return
+		}
+		if r.URL.Path == "/hijack" {
+			c, rw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				panic(err)
+			}
+			go func() {
+				defer c.Close()
+				rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n\r\n")
+				b := make([]byte, 4)
+				_, err := io.ReadFull(rw, b)
+				if err != nil {
+					panic(err)
+				}
+				rw.Write(b)
+				rw.Flush()
+			}()
+			return
+		}
 		if r.Method == "HEAD" {
 			return
 		}
@@ -253,22 +645,1090 @@ func test1(serverAddr string) {
 		}
 	})
 	requestTestHlfhrHandler(serverAddr)
+	requestTestHijack(serverAddr)
+	requestTestStream(serverAddr)
+
+	srv.HlfhrKeepAlive = true
+	requestTestKeepAlive(serverAddr)
+	requestTestNoBody(serverAddr)
+	requestTestInformational(serverAddr)
+
+	srv.HlfhrMaxBodyBytes = 1024
+	requestTestBodyLimit(serverAddr)
 
 	println("Shutdown")
+	// In-flight HlfhrHandler
+	c := dial(serverAddr)
+	defer c.Close()
+	_, err := io.WriteString(c, "GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if err != nil {
+		panic(err)
+	}
+	select {
+	case <-slowStarted:
+	case <-time.After(time.Second):
+		panic("/slow not started")
+	}
+
 	err = srv.Shutdown(context.Background())
 	if err != nil {
 		panic(err)
 	}
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		panic(err)
+	}
+	if resp.StatusCode != 200 {
+		panic(resp.StatusCode)
+	}
+	if err := <-serveErr; err != http.ErrServerClosed {
+		panic(err)
+	}
+
+	if st := srv.Stats(); st.TLSConns == 0 || st.SamePortHTTPConns == 0 || st.HlfhrHandlerCalls == 0 || st.OtherProtocolConns == 0 {
+		panic(fmt.Sprintf("%+v", st))
+	}
+	// The last callbacks may run after Shutdown returned.
+	waitFor(func() bool {
+		connStateMu.Lock()
+		defer connStateMu.Unlock()
+		return connStates[http.StateNew] != 0 && connStates[http.StateNew] == connStates[http.StateClosed]+connStates[http.StateHijacked]
+	})
+	println()
+}
+
+func testFirstByteTimeout() {
+	println("testFirstByteTimeout")
+
+	l := listen()
+	srv := hlfhr.New(&http.Server{
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	})
+	srv.HlfhrFirstByteTimeout = 100 * time.Millisecond
+	go srv.ServeHTTPRedirect(l)
+	defer srv.Close()
+
+	// Send nothing, the server should close the connection.
+	c := dial(l.Addr().String())
+	defer c.Close()
+	b, err := readAll(c)
+	if err != nil {
+		panic(err)
+	}
+	if len(b) != 0 {
+		panic(string(b))
+	}
+	println()
+}
+
+func testShutdownNewConn() {
+	println("testShutdownNewConn")
+
+	l := listen()
+	serverAddr := l.Addr().String()
+	srv := hlfhr.New(&http.Server{
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	})
+	states := make(chan http.ConnState, 1)
+	srv.HlfhrConnState = func(c *hlfhr.Conn, state http.ConnState) {
+		select {
+		case states <- state:
+		default:
+		}
+	}
+	go srv.ServeHTTPRedirect(l)
+
+	// Accepted, the request is not sent yet.
+	c := dial(serverAddr)
+	defer c.Close()
+	select {
+	case <-states:
+	case <-time.After(time.Second):
+		panic("StateNew not reported")
+	}
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- srv.Shutdown(context.Background())
+	}()
+	waitFor(func() bool {
+		c, err := net.Dial("tcp", serverAddr)
+		if err != nil {
+			return true
+		}
+		c.Close()
+		return false
+	})
+
+	resp, _ := roundTrip(c, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if resp.StatusCode != 307 {
+		panic(resp.StatusCode)
+	}
+	select {
+	case err := <-shutdownErr:
+		if err != nil {
+			panic(err)
+		}
+	case <-time.After(time.Second):
+		panic("Shutdown not returned")
+	}
+	println()
+}
+
+func testProxyProtocol() {
+	println("testProxyProtocol")
+
+	l := listen()
+	serverAddr := l.Addr().String()
+	srv := hlfhr.New(&http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.RemoteAddr)
+		}),
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	})
+	srv.HlfhrHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		io.WriteString(w, r.RemoteAddr)
+	})
+	srv.ProxyProtocol = true
+	srv.ProxyProtocolTimeout = 3 * time.Second
+	var hookAddrsMu sync.Mutex
+	var hookAddrs []string
+	srv.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			hookAddrsMu.Lock()
+			hookAddrs = append(hookAddrs, c.RemoteAddr().String())
+			hookAddrsMu.Unlock()
+		}
+	}
+
+	go srv.ServeTLS(l, "invalid.crt", "invalid.key")
+	defer srv.Close()
+
+	// An idle client without the header should not block the others.
+	idle := dial(serverAddr)
+	defer idle.Close()
+
+	// HTTPS
+	{
+		c := dial(serverAddr)
+		_, err := io.WriteString(c, "PROXY TCP4 192.0.2.1 192.0.2.2 12345 443\r\n")
+		if err != nil {
+			panic(err)
+		}
+		_, b := roundTrip(tls.Client(c, &tls.Config{InsecureSkipVerify: true}), "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		c.Close()
+		if string(b) != "192.0.2.1:12345" {
+			panic(string(b))
+		}
+		hookAddrsMu.Lock()
+		if len(hookAddrs) != 1 || hookAddrs[0] != "192.0.2.1:12345" {
+			panic(fmt.Sprint(hookAddrs))
+		}
+		hookAddrsMu.Unlock()
+	}
+
+	for _, header := range []string{
+		"PROXY TCP4 192.0.2.1 192.0.2.2 12345 443\r\n",
+		"\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0C\xC0\x00\x02\x01\xC0\x00\x02\x02\x30\x39\x01\xBB",
+	} {
+		_, b := rawRequest(serverAddr, header+"GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		if string(b) != "192.0.2.1:12345" {
+			panic(string(b))
+		}
+	}
+
+	// Missing header
+	c := dial(serverAddr)
+	defer c.Close()
+	_, err := io.WriteString(c, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if err != nil {
+		panic(err)
+	}
+	if b, _ := readAll(c); len(b) != 0 {
+		panic(string(b))
+	}
+	println()
+}
+
+func testListenRedirects() {
+	println("testListenRedirects")
+
+	l := listen()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	redirectAddrs := freeAddrs(2)
+	srv := hlfhr.New(&http.Server{
+		Addr:     l.Addr().String(),
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	})
+	srv.ListenRedirects = []hlfhr.ListenRedirect{
+		{Addr: redirectAddrs[0]},
+		{Addr: redirectAddrs[1], ToPort: "443"},
+	}
+	srv.AllowedHosts = []string{"localhost", "*.example.com", "::1"}
+	var eventsMu sync.Mutex
+	var events []*hlfhr.Event
+	srv.Logger = hlfhr.LoggerFunc(func(e *hlfhr.Event) {
+		eventsMu.Lock()
+		events = append(events, e)
+		eventsMu.Unlock()
+	})
+	srv.ACMEChallenge = hlfhr.ACMEChallengeMap{"token1": "token1.key"}
+	srv.ACMEHTTPHandler = func(fallback http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == hlfhr.ACMEChallengePath+"token2" {
+				io.WriteString(w, "token2.key")
+				return
+			}
+			fallback.ServeHTTP(w, r)
+		})
+	}
+
+	go srv.ServeTLS(l, "invalid.crt", "invalid.key")
+
+	// Listener created by the caller
+	lc := listen()
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.ServeHTTPRedirect(lc)
+	}()
+	for _, addr := range redirectAddrs {
+		waitListening(addr)
+	}
+
+	for addr, location := range map[string]string{
+		redirectAddrs[0]:   "https://localhost:" + port + "/a?b",
+		redirectAddrs[1]:   "https://localhost/a?b",
+		lc.Addr().String(): "https://localhost:" + port + "/a?b",
+	} {
+		resp, _ := rawRequest(addr, "GET /a?b HTTP/1.1\r\nHost: localhost:8080\r\n\r\n")
+		if resp.StatusCode != 307 {
+			panic(resp.StatusCode)
+		}
+		if v := resp.Header.Get("Location"); v != location {
+			panic(v)
+		}
+	}
+
+	// AllowedHosts
+	for host, code := range map[string]int{
+		"localhost:8080":  307,
+		"a.example.com":   307,
+		"[::1]":           307,
+		"example.com":     421,
+		"evil.test":       421,
+		"127.0.0.1":       421,
+		"a.example.com.x": 421,
+	} {
+		resp, _ := rawRequest(redirectAddrs[0], "GET / HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+		if resp.StatusCode != code {
+			panic(host + ": " + resp.Status)
+		}
+	}
+
+	// ACME HTTP-01 challenge
+	for path, want := range map[string]string{
+		"/.well-known/acme-challenge/token1": "token1.key",
+		"/.well-known/acme-challenge/token2": "token2.key",
+		"/.well-known/acme-challenge/token3": "",
+	} {
+		resp, b := rawRequest(redirectAddrs[0], "GET "+path+" HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		if want == "" {
+			if resp.StatusCode != 404 {
+				panic(resp.StatusCode)
+			}
+		} else if resp.StatusCode != 200 || string(b) != want {
+			panic(string(b))
+		}
+	}
+
+	// Stats
+	st := srv.Stats()
+	if st.PlainListenerConns == 0 || st.Redirects[307] == 0 || st.UnknownHosts != 4 || st.TLSConns != 0 {
+		panic(fmt.Sprintf("%+v", st))
+	}
+	w := httptest.NewRecorder()
+	srv.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if b := w.Body.String(); !strings.Contains(b, "\nhlfhr_unknown_hosts_total 4\n") || !strings.Contains(b, "\nhlfhr_redirects_total{code=\"307\"} ") {
+		panic(b)
+	}
+	eventsMu.Lock()
+	if len(events) != 4 || events[0].Kind != hlfhr.EventUnknownHost || events[0].RemoteAddr == "" {
+		panic(fmt.Sprint(events))
+	}
+	eventsMu.Unlock()
+	expvar.Publish("hlfhr_test", expvar.Func(srv.StatsFunc()))
+	if v := expvar.Get("hlfhr_test").String(); !strings.Contains(v, `"UnknownHosts":4`) {
+		panic(v)
+	}
+
+	srv.Close()
+	select {
+	case err := <-serveErr:
+		if err != http.ErrServerClosed {
+			panic(err)
+		}
+	case <-time.After(time.Second):
+		panic("ServeHTTPRedirect not returned")
+	}
+	println()
+}
+
+func testServeHTTPRedirectZero() {
+	println("testServeHTTPRedirectZero")
+
+	l := listen()
+	srv := &hlfhr.Server{}
+	go srv.ServeHTTPRedirect(l)
+	defer srv.Close()
+
+	resp, _ := rawRequest(l.Addr().String(), "GET /a HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if v := resp.Header.Get("Location"); resp.StatusCode != 307 || v != "https://localhost/a" {
+		panic(fmt.Sprint(resp.StatusCode, v))
+	}
+	println()
+}
+
+// Like autocert.Manager, using invalid.crt.
+type fakeCertManager struct {
+	cert         *tls.Certificate
+	handlerCalls int32 // accessed atomically
+}
+
+func (m *fakeCertManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if hello.ServerName == "other.test" {
+		return nil, errors.New("host not allowed")
+	}
+	return m.cert, nil
+}
+
+func (m *fakeCertManager) HTTPHandler(fallback http.Handler) http.Handler {
+	atomic.AddInt32(&m.handlerCalls, 1)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == hlfhr.ACMEChallengePath+"token" {
+			w.Write([]byte("token.key"))
+			return
+		}
+		fallback.ServeHTTP(w, r)
+	})
+}
+
+func testCertManager() {
+	println("testCertManager")
+
+	cert, err := tls.LoadX509KeyPair("invalid.crt", "invalid.key")
+	if err != nil {
+		panic(err)
+	}
+	l := listen()
+	serverAddr := l.Addr().String()
+	redirectAddr := freeAddrs(1)[0]
+	srv := hlfhr.New(&http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "ok")
+		}),
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	})
+	m := &fakeCertManager{cert: &cert}
+	srv.CertManager = m
+	srv.ListenRedirects = []hlfhr.ListenRedirect{{Addr: redirectAddr}}
+	var fallbackCalls int32
+	srv.TLSConfig = &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			atomic.AddInt32(&fallbackCalls, 1)
+			return &cert, nil
+		},
+	}
+
+	go srv.ServeTLS(l, "", "")
+	defer srv.Close()
+
+	// TLS-ALPN-01
+	tc, err := tls.Dial("tcp", serverAddr, &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"acme-tls/1"},
+	})
+	if err != nil {
+		panic(err)
+	}
+	p := tc.ConnectionState().NegotiatedProtocol
+	tc.Close()
+	if p != "acme-tls/1" {
+		panic(p)
+	}
+	if n := atomic.LoadInt32(&fallbackCalls); n != 0 {
+		panic(n)
+	}
+
+	// GetCertificate of TLSConfig as the fallback
+	tc, err = tls.Dial("tcp", serverAddr, &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         "other.test",
+	})
+	if err != nil {
+		panic(err)
+	}
+	tc.Close()
+	if n := atomic.LoadInt32(&fallbackCalls); n != 1 {
+		panic(n)
+	}
+
+	// HTTP-01
+	waitListening(redirectAddr)
+	resp, b := rawRequest(redirectAddr, "GET /.well-known/acme-challenge/token HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if resp.StatusCode != 200 || string(b) != "token.key" {
+		panic(string(b))
+	}
+	// Called once before serving, autocert.Manager needs it for HTTP-01.
+	if n := atomic.LoadInt32(&m.handlerCalls); n != 1 {
+		panic(n)
+	}
+	println()
+}
+
+func testCertManagerKeyPairs() {
+	println("testCertManagerKeyPairs")
+
+	dir, err := ioutil.TempDir("", "hlfhr")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestCert(filepath.Join(dir, "managed.crt"), filepath.Join(dir, "managed.key"), "managed.test")
+	writeTestCert(filepath.Join(dir, "other.crt"), filepath.Join(dir, "other.key"), "other.test")
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, "managed.crt"), filepath.Join(dir, "managed.key"))
+	if err != nil {
+		panic(err)
+	}
+
+	l := listen()
+	serverAddr := l.Addr().String()
+	srv := hlfhr.New(&http.Server{
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	})
+	srv.CertManager = &fakeCertManager{cert: &cert}
+	srv.KeyPairs = []hlfhr.KeyPair{{
+		CertFile: filepath.Join(dir, "other.crt"),
+		KeyFile:  filepath.Join(dir, "other.key"),
+	}}
+
+	go srv.ServeTLS(l, "", "")
+	defer srv.Close()
+
+	// KeyPairs for the hosts CertManager returns an error.
+	if name := serverCertName(serverAddr, "other.test"); name != "other.test" {
+		panic(name)
+	}
+	if name := serverCertName(serverAddr, "managed.test"); name != "managed.test" {
+		panic(name)
+	}
+	println()
+}
+
+// Writes a new self-signed certificate to the files.
+// If names is empty, it's for localhost.
+func writeTestCert(certFile, keyFile string, names ...string) {
+	if len(names) == 0 {
+		names = []string{"localhost"}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		panic(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, &x509.Certificate{SerialNumber: serial}, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		panic(err)
+	}
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		panic(err)
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Returns the first DNS name of the certificate served on serverAddr for the SNI.
+func serverCertName(serverAddr, serverName string) string {
+	c, err := tls.Dial("tcp", serverAddr, &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         serverName,
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer c.Close()
+	return c.ConnectionState().PeerCertificates[0].DNSNames[0]
+}
+
+// Returns the serial number of the certificate served on serverAddr.
+func serverCertSerial(serverAddr string) string {
+	c, err := tls.Dial("tcp", serverAddr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		panic(err)
+	}
+	defer c.Close()
+	return c.ConnectionState().PeerCertificates[0].SerialNumber.String()
+}
+
+func testCertReload() {
+	println("testCertReload")
+
+	dir, err := ioutil.TempDir("", "hlfhr")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "localhost.crt")
+	keyFile := filepath.Join(dir, "localhost.key")
+	writeTestCert(certFile, keyFile)
+
+	l := listen()
+	serverAddr := l.Addr().String()
+	srv := hlfhr.New(&http.Server{
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	})
+	srv.CertReloadInterval = 20 * time.Millisecond
+	// Replaced by certFile, even for the clients without SNI.
+	invalidCert, err := tls.LoadX509KeyPair("invalid.crt", "invalid.key")
+	if err != nil {
+		panic(err)
+	}
+	srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{invalidCert}}
+	var reloadErrors int32
+	srv.Logger = hlfhr.LoggerFunc(func(e *hlfhr.Event) {
+		if e.Kind == hlfhr.EventCertReloadError {
+			atomic.AddInt32(&reloadErrors, 1)
+		}
+	})
+
+	go srv.ServeTLS(l, certFile, keyFile)
+	defer srv.Close()
+
+	serial1 := serverCertSerial(serverAddr)
+
+	// Polling
+	writeTestCert(certFile, keyFile)
+	// The mod time may be in seconds.
+	mtime := time.Now().Add(time.Minute)
+	err = os.Chtimes(certFile, mtime, mtime)
+	if err != nil {
+		panic(err)
+	}
+	waitFor(func() bool {
+		return serverCertSerial(serverAddr) != serial1
+	})
+	serial2 := serverCertSerial(serverAddr)
+
+	// Invalid files, keep the old certificate.
+	err = ioutil.WriteFile(keyFile, []byte("invalid"), 0600)
+	if err != nil {
+		panic(err)
+	}
+	waitFor(func() bool {
+		return atomic.LoadInt32(&reloadErrors) != 0
+	})
+	if serial := serverCertSerial(serverAddr); serial != serial2 {
+		panic(serial)
+	}
+	if srv.ReloadCertificate() == nil {
+		panic("ReloadCertificate: expected error")
+	}
+
+	// Reload immediately
+	writeTestCert(certFile, keyFile)
+	err = srv.ReloadCertificate()
+	if err != nil {
+		panic(err)
+	}
+	if serial := serverCertSerial(serverAddr); serial == serial2 {
+		panic("certificate not reloaded")
+	}
+	println()
+}
+
+func testKeyPairs() {
+	println("testKeyPairs")
+
+	dir, err := ioutil.TempDir("", "hlfhr")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestCert(filepath.Join(dir, "default.crt"), filepath.Join(dir, "default.key"), "default.test")
+	pemDir := filepath.Join(dir, "pem")
+	err = os.Mkdir(pemDir, 0700)
+	if err != nil {
+		panic(err)
+	}
+	writeTestCert(filepath.Join(pemDir, "a.crt"), filepath.Join(pemDir, "a.key"), "a.test")
+	certPEM, err := ioutil.ReadFile(filepath.Join(pemDir, "a.crt"))
+	if err != nil {
+		panic(err)
+	}
+	keyPEM, err := ioutil.ReadFile(filepath.Join(pemDir, "a.key"))
+	if err != nil {
+		panic(err)
+	}
+	keyPairsDir := filepath.Join(dir, "certs")
+	err = os.Mkdir(keyPairsDir, 0700)
+	if err != nil {
+		panic(err)
+	}
+	writeTestCert(filepath.Join(keyPairsDir, "b.test.crt"), filepath.Join(keyPairsDir, "b.test.key"), "b.test")
+	writeTestCert(filepath.Join(keyPairsDir, "c.test.crt"), filepath.Join(keyPairsDir, "c.test.key"), "*.c.test")
+
+	l := listen()
+	serverAddr := l.Addr().String()
+	srv := hlfhr.New(&http.Server{
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	})
+	srv.KeyPairs = []hlfhr.KeyPair{{CertPEM: certPEM, KeyPEM: keyPEM}}
+	srv.KeyPairsDir = keyPairsDir
+
+	go srv.ServeTLS(l, filepath.Join(dir, "default.crt"), filepath.Join(dir, "default.key"))
+	defer srv.Close()
+
+	for serverName, want := range map[string]string{
+		"a.test":       "a.test",
+		"B.test":       "b.test",
+		"www.c.test":   "*.c.test",
+		"c.test":       "default.test",
+		"x.www.c.test": "default.test",
+		"":             "default.test",
+	} {
+		if name := serverCertName(serverAddr, serverName); name != want {
+			panic(serverName + ": " + name)
+		}
+	}
+
+	// A new file in the directory
+	writeTestCert(filepath.Join(keyPairsDir, "d.test.crt"), filepath.Join(keyPairsDir, "d.test.key"), "d.test")
+	err = srv.ReloadCertificate()
+	if err != nil {
+		panic(err)
+	}
+	if name := serverCertName(serverAddr, "d.test"); name != "d.test" {
+		panic(name)
+	}
+	println()
+}
+
+func testDevCert() {
+	println("testDevCert")
+
+	dir, err := ioutil.TempDir("", "hlfhr")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l := listen()
+	serverAddr := l.Addr().String()
+	srv := hlfhr.New(&http.Server{
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	})
+	srv.DevCert = &hlfhr.DevCert{
+		Hosts:      []string{"dev.test"},
+		CACertFile: filepath.Join(dir, "ca.crt"),
+		CAKeyFile:  filepath.Join(dir, "ca.key"),
+	}
+	srv.HSTS = &hlfhr.HSTS{MaxAge: 365 * 24 * time.Hour, IncludeSubDomains: true}
+	srv.AllowedHosts = []string{"localhost"}
+	srv.AllowedHostsTLS = true
+	srv.UnknownHostCode = 400
+
+	go srv.ServeTLS(l, "", "")
+	defer srv.Close()
+
+	// The CA files are written before serving.
+	serverCertName(serverAddr, "localhost")
+	caPEM, err := ioutil.ReadFile(srv.DevCert.CACertFile)
+	if err != nil {
+		panic(err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		panic("invalid CA")
+	}
+	for _, serverName := range []string{"localhost", "dev.test", "127.0.0.1"} {
+		c, err := tls.Dial("tcp", serverAddr, &tls.Config{
+			RootCAs:    roots,
+			ServerName: serverName,
+		})
+		if err != nil {
+			panic(err)
+		}
+		c.Close()
+	}
+
+	// HSTS
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+		Timeout:   time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	defer client.CloseIdleConnections()
+	_, port, _ := net.SplitHostPort(serverAddr)
+	resp, err := client.Get("https://127.0.0.1:" + port)
+	if err != nil {
+		panic(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		panic(resp.Status)
+	}
+	for url, want := range map[string]string{
+		"https://localhost:" + port: "max-age=31536000; includeSubDomains",
+		"http://localhost:" + port:  "",
+	} {
+		resp, err := client.Get(url)
+		if err != nil {
+			panic(err)
+		}
+		resp.Body.Close()
+		if v := resp.Header.Get("Strict-Transport-Security"); v != want {
+			panic(url + ": " + v)
+		}
+	}
+
+	// The handler is restored after Shutdown.
+	client.CloseIdleConnections()
+	if err := srv.Shutdown(context.Background()); err != nil {
+		panic(err)
+	}
+	if srv.Handler != nil {
+		panic(srv.Handler)
+	}
+	println()
+}
+
+func testCloseHandler() {
+	println("testCloseHandler")
+
+	l := listen()
+	serverAddr := l.Addr().String()
+	h := http.NewServeMux()
+	srv := hlfhr.New(&http.Server{
+		Handler:  h,
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	})
+	srv.TLSConfig = &tls.Config{GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := tls.LoadX509KeyPair("invalid.crt", "invalid.key")
+		return &cert, err
+	}}
+	srv.HSTS = &hlfhr.HSTS{MaxAge: time.Hour}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.ServeTLS(l, "", "")
+	}()
+	// Serving after the handshake.
+	c, err := tls.Dial("tcp", serverAddr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		panic(err)
+	}
+	c.Close()
+
+	// The handler is restored after Close.
+	if err := srv.Close(); err != nil {
+		panic(err)
+	}
+	if err := <-done; err != http.ErrServerClosed {
+		panic(err)
+	}
+	if srv.Handler != h {
+		panic(srv.Handler)
+	}
+	println()
+}
+
+func testRedirectPolicy() {
+	println("testRedirectPolicy")
+
+	for _, tt := range []struct {
+		policy   hlfhr.RedirectPolicy
+		method   string
+		target   string
+		host     string
+		code     int
+		location string
+	}{
+		{hlfhr.RedirectPolicy{}, "GET", "/a?b", "localhost", 307, "https://localhost/a?b"},
+		{hlfhr.RedirectPolicy{}, "GET", "/", "localhost:80", 307, "https://localhost/"},
+		{hlfhr.RedirectPolicy{}, "GET", "/", "localhost:8443", 307, "https://localhost:8443/"},
+		{hlfhr.RedirectPolicy{}, "GET", "/", "[::1]:8443", 307, "https://[::1]:8443/"},
+		{hlfhr.RedirectPolicy{}, "GET", "/", "[::1]", 307, "https://[::1]/"},
+		{hlfhr.RedirectPolicy{Code: 301}, "HEAD", "/", "localhost", 301, "https://localhost/"},
+		{hlfhr.RedirectPolicy{Code: 301}, "POST", "/", "localhost", 308, "https://localhost/"},
+		{hlfhr.RedirectPolicy{Code: 301, CodeOtherMethods: 307}, "POST", "/", "localhost", 307, "https://localhost/"},
+		{hlfhr.RedirectPolicy{Host: "example.com"}, "GET", "/a", "www.example.com:80", 307, "https://example.com/a"},
+		{hlfhr.RedirectPolicy{Host: "example.com", HostAliases: []string{"www.example.com"}}, "GET", "/a", "WWW.example.com", 307, "https://example.com/a"},
+		{hlfhr.RedirectPolicy{Host: "example.com", HostAliases: []string{"www.example.com"}}, "GET", "/a", "api.example.com", 307, "https://api.example.com/a"},
+		{hlfhr.RedirectPolicy{Port: "8443"}, "GET", "/a", "[::1]:80", 307, "https://[::1]:8443/a"},
+		{hlfhr.RedirectPolicy{Port: "443"}, "GET", "/a", "localhost:8080", 307, "https://localhost/a"},
+		{hlfhr.RedirectPolicy{DiscardPath: true, DiscardQuery: true}, "GET", "/a?b", "localhost", 307, "https://localhost/"},
+	} {
+		r, err := http.ReadRequest(bufio.NewReader(strings.NewReader(tt.method + " " + tt.target + " HTTP/1.1\r\nHost: " + tt.host + "\r\n\r\n")))
+		if err != nil {
+			panic(err)
+		}
+		w := httptest.NewRecorder()
+		tt.policy.Redirect(w, r)
+		if w.Code != tt.code || w.Header().Get("Location") != tt.location {
+			panic(fmt.Sprint(tt.host, tt.target, ": ", w.Code, " ", w.Header().Get("Location")))
+		}
+	}
+	println()
+}
+
+func testRateLimitLogger() {
+	println("testRateLimitLogger")
+
+	var events []*hlfhr.Event
+	l := hlfhr.NewRateLimitLogger(hlfhr.LoggerFunc(func(e *hlfhr.Event) {
+		events = append(events, e)
+	}), 50*time.Millisecond, 2)
+	for i := 0; i < 5; i++ {
+		l.Log(&hlfhr.Event{Kind: hlfhr.EventReadRequestError})
+	}
+	l.Log(&hlfhr.Event{Kind: hlfhr.EventWriteError})
+	if len(events) != 3 {
+		panic(len(events))
+	}
+	time.Sleep(60 * time.Millisecond)
+	l.Log(&hlfhr.Event{Kind: hlfhr.EventReadRequestError})
+	if len(events) != 4 || events[3].Suppressed != 3 {
+		panic(fmt.Sprint(events))
+	}
+	println()
+}
+
+func testLimits() {
+	println("testLimits")
+
+	l := listen()
+	serverAddr := l.Addr().String()
+	srv := hlfhr.New(&http.Server{
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	})
+	srv.HlfhrMaxConns = 1
+	srv.HlfhrRateLimit = 0.001
+	srv.HlfhrRateBurst = 2
+	srv.HlfhrRejectCode = 429
+	states := make(chan http.ConnState, 16)
+	srv.HlfhrConnState = func(c *hlfhr.Conn, state http.ConnState) {
+		states <- state
+	}
+
+	go srv.ServeHTTPRedirect(l)
+	defer srv.Close()
+
+	// The rejected connections are not reported.
+	waitState := func(want http.ConnState) {
+		for {
+			select {
+			case state := <-states:
+				if state == want {
+					return
+				}
+			case <-time.After(time.Second):
+				panic(want.String())
+			}
+		}
+	}
+	get := func() int {
+		resp, _ := rawRequest(serverAddr, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		return resp.StatusCode
+	}
+
+	// Occupy the only connection.
+	c := dial(serverAddr)
+	waitState(http.StateNew)
+	if code := get(); code != 429 {
+		panic(code)
+	}
+	c.Close()
+	waitState(http.StateClosed)
+
+	// The second token
+	if code := get(); code != 307 {
+		panic(code)
+	}
+	waitState(http.StateClosed)
+	if code := get(); code != 429 {
+		panic(code)
+	}
+
+	if st := srv.Stats(); st.MaxConnsRejected != 1 || st.RateLimitRejected != 1 {
+		panic(fmt.Sprintf("%+v", st))
+	}
+	println()
+}
+
+type testContextKey string
+
+func testContext() {
+	println("testContext")
+
+	l := listen()
+	redirectAddr := freeAddrs(1)[0]
+	srv := hlfhr.New(&http.Server{
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+		BaseContext: func(l net.Listener) context.Context {
+			return context.WithValue(context.Background(), testContextKey("listener"), l.Addr().String())
+		},
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, testContextKey("conn"), "hlfhr")
+		},
+	})
+	srv.ListenRedirects = []hlfhr.ListenRedirect{{Addr: redirectAddr}}
+	srv.HlfhrHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		w.WriteHeader(200)
+		fmt.Fprintln(w,
+			r.RemoteAddr != "",
+			ctx.Value(http.ServerContextKey) == srv.Server,
+			ctx.Value(http.LocalAddrContextKey),
+			ctx.Value(testContextKey("listener")),
+			ctx.Value(testContextKey("conn")),
+		)
+	})
+
+	go srv.ServeTLS(l, "invalid.crt", "invalid.key")
+	defer srv.Close()
+	waitListening(redirectAddr)
+
+	for _, addr := range []string{l.Addr().String(), redirectAddr} {
+		_, b := rawRequest(addr, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		if want := fmt.Sprintln(true, true, addr, addr, "hlfhr"); string(b) != want {
+			panic(string(b) + " != " + want)
+		}
+	}
+	println()
+}
+
+func testHijackDeadline() {
+	println("testHijackDeadline")
+
+	l := listen()
+	srv := hlfhr.New(&http.Server{
+		ReadTimeout:  200 * time.Millisecond,
+		WriteTimeout: 200 * time.Millisecond,
+		ErrorLog:     log.New(ioutil.Discard, "", 0),
+	})
+	srv.HlfhrHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			panic(err)
+		}
+		go func() {
+			defer c.Close()
+			rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n\r\n")
+			rw.Flush()
+			// Longer than the timeouts.
+			b := make([]byte, 4)
+			if _, err := io.ReadFull(rw, b); err != nil {
+				rw.WriteString(err.Error())
+			} else {
+				rw.Write(b)
+			}
+			rw.Flush()
+		}()
+	})
+	go srv.ServeTLS(l, "invalid.crt", "invalid.key")
+	defer srv.Close()
+
+	c := dial(l.Addr().String())
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	_, err := io.WriteString(c, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if err != nil {
+		panic(err)
+	}
+	br := bufio.NewReader(c)
+	line, err := br.ReadString('\n')
+	if err != nil || line != "HTTP/1.1 101 Switching Protocols\r\n" {
+		panic(fmt.Sprint(line, err))
+	}
+	time.Sleep(400 * time.Millisecond)
+	_, err = io.WriteString(c, "ping")
+	if err != nil {
+		panic(err)
+	}
+	b, err := readAll(br)
+	if err != nil {
+		panic(err)
+	}
+	if string(b) != "\r\nping" {
+		panic(string(b))
+	}
+	println()
+}
+
+func testResponse() {
+	println("testResponse")
+
+	// NewResponse buffers the whole body, FlushError writes the complete response.
+	sc, cc := net.Pipe()
+	defer cc.Close()
+	go func() {
+		defer sc.Close()
+		w := hlfhr_lib.NewResponse(sc, 200, true)
+		io.WriteString(w, strings.Repeat("a", 5000))
+		w.FlushError()
+	}()
+	resp, err := http.ReadResponse(bufio.NewReader(cc), nil)
+	if err != nil {
+		panic(err)
+	}
+	if resp.ContentLength != 5000 || len(resp.TransferEncoding) != 0 || !resp.Close {
+		panic(fmt.Sprint(resp.ContentLength, resp.TransferEncoding, resp.Close))
+	}
 	println()
 }
 
 func Test(t *testing.T) {
+	testResponse()
+	testRedirectPolicy()
+	testRateLimitLogger()
 	test1("127.0.0.1:45876")
 	test1("[::1]:45876")
 	test1("127.0.0.1:80")
 	test1("[::1]:80")
 	test1("127.0.0.1:443")
 	test1("[::1]:443")
+	testFirstByteTimeout()
+	testShutdownNewConn()
+	testProxyProtocol()
+	testListenRedirects()
+	testServeHTTPRedirectZero()
+	testCertManager()
+	testCertManagerKeyPairs()
+	testCertReload()
+	testKeyPairs()
+	testDevCert()
+	testCloseHandler()
+	testLimits()
+	testContext()
+	testHijackDeadline()
 
 	println("OK\n")
 }
@@ -0,0 +1,128 @@
+//go:build pebble
+// +build pebble
+
+package main_test
+
+// Obtains and renews a certificate from a local Pebble ACME server
+// through CertManager, answering the challenges on hlfhr listeners.
+//
+// Start Pebble (https://github.com/letsencrypt/pebble) and its DNS server
+// resolving all names to 127.0.0.1, with the default ports 5001 and 5002
+// for the challenges:
+//
+//	pebble-challtestsrv -defaultIPv4 127.0.0.1 &
+//	PEBBLE_VA_NOSLEEP=1 pebble -config test/config/pebble-config.json -dnsserver 127.0.0.1:8053 &
+//	HLFHR_PEBBLE_CA=/path/to/pebble/test/certs/pebble.minica.pem go test -tags pebble -run TestPebble
+//
+// HLFHR_PEBBLE_DIRECTORY and HLFHR_PEBBLE_DOMAIN override the directory URL
+// and the domain.
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bddjr/hlfhr"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestPebble(t *testing.T) {
+	caFile := os.Getenv("HLFHR_PEBBLE_CA")
+	if caFile == "" {
+		t.Skip("HLFHR_PEBBLE_CA is not set")
+	}
+	directory := os.Getenv("HLFHR_PEBBLE_DIRECTORY")
+	if directory == "" {
+		directory = "https://127.0.0.1:14000/dir"
+	}
+	domain := os.Getenv("HLFHR_PEBBLE_DOMAIN")
+	if domain == "" {
+		domain = "hlfhr.test"
+	}
+
+	caPEM, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		t.Fatal("invalid HLFHR_PEBBLE_CA")
+	}
+	cacheDir, err := ioutil.TempDir("", "hlfhr-pebble")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domain),
+		Cache:      autocert.DirCache(cacheDir),
+		// Longer than the validity of Pebble certificates,
+		// so that it's renewed right after issued.
+		RenewBefore: 100 * 365 * 24 * time.Hour,
+		Client: &acme.Client{
+			DirectoryURL: directory,
+			HTTPClient: &http.Client{Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: roots},
+			}},
+		},
+	}
+
+	// Pebble validates TLS-ALPN-01 on port 5001 and HTTP-01 on port 5002.
+	l, err := net.Listen("tcp", "127.0.0.1:5001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := hlfhr.New(&http.Server{
+		Handler:  http.NotFoundHandler(),
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	})
+	srv.CertManager = m
+	srv.ListenRedirects = []hlfhr.ListenRedirect{{Addr: "127.0.0.1:5002"}}
+	go srv.ServeTLS(l, "", "")
+	defer srv.Close()
+
+	leaf := func() *x509.Certificate {
+		tc, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			ServerName:         domain,
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tc.Close()
+		return tc.ConnectionState().PeerCertificates[0]
+	}
+
+	// Issuance
+	first := leaf()
+	if err := first.VerifyHostname(domain); err != nil {
+		t.Fatal(err)
+	}
+	if first.Issuer.CommonName == first.Subject.CommonName {
+		t.Fatalf("not issued by Pebble: %v", first.Issuer)
+	}
+
+	// Renewal
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for {
+		if c := leaf(); c.SerialNumber.Cmp(first.SerialNumber) != 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("not renewed")
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main_test
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	hlfhr_utils "github.com/bddjr/hlfhr/utils"
+)
+
+func readTestRequest(t *testing.T, requestLine, host string) *http.Request {
+	raw := requestLine + "\r\n"
+	if host != "" {
+		raw += "Host: " + host + "\r\n"
+	}
+	r, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw + "\r\n")))
+	if err != nil {
+		t.Fatalf("%q: %v", requestLine, err)
+	}
+	return r
+}
+
+func TestNewHttpsURL(t *testing.T) {
+	for _, tt := range []struct {
+		requestLine string
+		host        string
+		want        string // empty for ErrInvalidHost
+	}{
+		// Host and port
+		{"GET / HTTP/1.1", "example.com", "https://example.com/"},
+		{"GET / HTTP/1.1", "example.com:8443", "https://example.com:8443/"},
+		{"GET / HTTP/1.1", "example.com:443", "https://example.com/"},
+		{"GET / HTTP/1.1", "example.com:", "https://example.com/"},
+		{"GET / HTTP/1.1", "127.0.0.1:8080", "https://127.0.0.1:8080/"},
+
+		// IPv6
+		{"GET / HTTP/1.1", "[::1]", "https://[::1]/"},
+		{"GET / HTTP/1.1", "[::1]:8443", "https://[::1]:8443/"},
+		{"GET / HTTP/1.1", "[fe80::1%25eth0]:8443", "https://[fe80::1%25eth0]:8443/"},
+		{"GET / HTTP/1.1", "[fe80::1%eth0]", "https://[fe80::1%25eth0]/"},
+
+		// Escaped path and query
+		{"GET /a%2Fb HTTP/1.1", "example.com", "https://example.com/a%2Fb"},
+		{"GET /a%20b/c HTTP/1.1", "example.com", "https://example.com/a%20b/c"},
+		{"GET /?a=1&b=%2F HTTP/1.1", "example.com", "https://example.com/?a=1&b=%2F"},
+		{"GET /? HTTP/1.1", "example.com", "https://example.com/?"},
+		{"OPTIONS * HTTP/1.1", "example.com", "https://example.com/*"},
+
+		// Open redirect, the path is kept after the host.
+		{"GET //evil.com HTTP/1.1", "example.com", "https://example.com//evil.com"},
+		{"GET ///evil.com/a HTTP/1.1", "example.com", "https://example.com///evil.com/a"},
+		{"GET /\\evil.com HTTP/1.1", "example.com", "https://example.com/%5Cevil.com"},
+
+		// Absolute-form
+		{"GET http://example.com/a?b HTTP/1.1", "other.com", "https://example.com/a?b"},
+		{"GET http://example.com:8443/a HTTP/1.1", "", "https://example.com:8443/a"},
+
+		// Invalid host
+		{"GET / HTTP/1.1", "", ""},
+		{"GET / HTTP/1.1", "evil.com/a", ""},
+		{"GET / HTTP/1.1", "evil.com@example.com", ""},
+		{"GET / HTTP/1.1", "evil.com\\example.com", ""},
+		{"GET / HTTP/1.1", "example.com:80a", ""},
+		{"GET / HTTP/1.1", "example.com%eth0", ""},
+	} {
+		r := readTestRequest(t, tt.requestLine, tt.host)
+		u, err := hlfhr_utils.NewHttpsURL(r)
+		if tt.want == "" {
+			if err != hlfhr_utils.ErrInvalidHost {
+				t.Errorf("%q, Host %q: got %v, want ErrInvalidHost", tt.requestLine, tt.host, u)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q, Host %q: %v", tt.requestLine, tt.host, err)
+			continue
+		}
+		if got := u.String(); got != tt.want {
+			t.Errorf("%q, Host %q: got %q, want %q", tt.requestLine, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestHttpsURLString(t *testing.T) {
+	for path, want := range map[string]string{
+		"":          "https://example.com/",
+		"@evil.com": "https://example.com/@evil.com",
+		".evil.com": "https://example.com/.evil.com",
+		"//a":       "https://example.com//a",
+	} {
+		u := &hlfhr_utils.HttpsURL{Hostname: "example.com", EscapedPath: path}
+		if got := u.String(); got != want {
+			t.Errorf("%q: got %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestRedirectToHttps(t *testing.T) {
+	for _, tt := range []struct {
+		host     string
+		code     int
+		location string
+	}{
+		{"example.com", 307, "https://example.com/a%2Fb"},
+		{"example.com:80", 307, "https://example.com/a%2Fb"},
+		{"example.com:8080", 307, "https://example.com:8080/a%2Fb"},
+		{"[::1]:80", 307, "https://[::1]/a%2Fb"},
+		{"evil.com/", 400, ""},
+	} {
+		r := readTestRequest(t, "GET /a%2Fb HTTP/1.1", tt.host)
+		w := httptest.NewRecorder()
+		hlfhr_utils.RedirectToHttps(w, r, 307)
+		if w.Code != tt.code || w.Header().Get("Location") != tt.location {
+			t.Errorf("Host %q: got %d %q, want %d %q", tt.host, w.Code, w.Header().Get("Location"), tt.code, tt.location)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+//go:build go1.21
+// +build go1.21
+
+package main_test
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/bddjr/hlfhr"
+)
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := hlfhr.NewSlogLogger(slog.New(slog.NewTextHandler(&buf, nil)))
+	l.Log(&hlfhr.Event{
+		Kind:       hlfhr.EventReadRequestError,
+		RemoteAddr: "192.0.2.1:1234",
+		Err:        errors.New("malformed HTTP request"),
+		Message:    "hlfhr: Read request error",
+	})
+	got := buf.String()
+	for _, want := range []string{
+		"level=WARN",
+		`msg="hlfhr: Read request error"`,
+		"kind=read_request_error",
+		"remote_addr=192.0.2.1:1234",
+		`error="malformed HTTP request"`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %s in %q", want, got)
+		}
+	}
+}
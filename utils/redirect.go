@@ -2,7 +2,6 @@ package hlfhr_utils
 
 import (
 	"net/http"
-	"strings"
 )
 
 // Redirect without HTTP body.
@@ -11,27 +10,69 @@ func Redirect(w http.ResponseWriter, code int, url string) {
 	w.WriteHeader(code)
 }
 
-// Redirect without HTTP body.
+// Redirect without HTTP body, port 80 is omitted.
+//
+// Deprecated: Use RedirectPolicy of github.com/bddjr/hlfhr instead.
 func RedirectToHttps(w http.ResponseWriter, r *http.Request, code int) {
-	RedirectToHttps_ModifyHost(w, r, code, strings.TrimSuffix(r.Host, ":80"))
+	redirectToHttps(w, r, code, func(u *HttpsURL) {
+		if u.Port == "80" {
+			u.Port = ""
+		}
+	})
 }
 
+// Redirect without HTTP body, port 80 is kept if it's omitted in the request.
+//
+// Deprecated: Use RedirectPolicy of github.com/bddjr/hlfhr instead.
 func RedirectToHttps_ForceSamePort(w http.ResponseWriter, r *http.Request, code int) {
-	host := r.Host
-	if r.TLS == nil && !strings.HasSuffix(host, "]") && strings.LastIndexByte(host, ':') == -1 {
-		host += ":80"
-	}
-	RedirectToHttps_ModifyHost(w, r, code, host)
+	redirectToHttps(w, r, code, func(u *HttpsURL) {
+		if r.TLS == nil && u.Port == "" {
+			u.Port = "80"
+		}
+	})
 }
 
+// Redirect without HTTP body, the port is kept.
+//
+// Deprecated: Use RedirectPolicy of github.com/bddjr/hlfhr instead.
 func RedirectToHttps_NoCheckPort(w http.ResponseWriter, r *http.Request, code int) {
-	RedirectToHttps_ModifyHost(w, r, code, r.Host)
+	redirectToHttps(w, r, code, nil)
 }
 
+// Redirect without HTTP body, replaces the host, such as "example.com:8443".
+//
+// Deprecated: Use RedirectPolicy of github.com/bddjr/hlfhr instead.
 func RedirectToHttps_ModifyHost(w http.ResponseWriter, r *http.Request, code int, host string) {
-	url := "https://" + host + r.URL.Path
-	if r.URL.ForceQuery || r.URL.RawQuery != "" {
-		url += "?" + r.URL.RawQuery
+	hostname, port, err := SplitHost(host)
+	if err != nil {
+		writeInvalidHost(w)
+		return
+	}
+	u := &HttpsURL{
+		Hostname:    hostname,
+		Port:        port,
+		EscapedPath: r.URL.EscapedPath(),
+		RawQuery:    r.URL.RawQuery,
+		ForceQuery:  r.URL.ForceQuery,
 	}
-	Redirect(w, code, url)
+	Redirect(w, code, u.String())
+}
+
+// Builds the URL by [NewHttpsURL], modifies it, then redirects.
+// If the host is invalid, it responds 400.
+func redirectToHttps(w http.ResponseWriter, r *http.Request, code int, modify func(u *HttpsURL)) {
+	u, err := NewHttpsURL(r)
+	if err != nil {
+		writeInvalidHost(w)
+		return
+	}
+	if modify != nil {
+		modify(u)
+	}
+	Redirect(w, code, u.String())
+}
+
+func writeInvalidHost(w http.ResponseWriter) {
+	w.WriteHeader(400)
+	w.Write([]byte("invalid Host header"))
 }
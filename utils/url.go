@@ -0,0 +1,135 @@
+package hlfhr_utils
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var ErrInvalidHost = errors.New("hlfhr: invalid host")
+
+// HttpsURL is the target of redirecting a request to HTTPS.
+type HttpsURL struct {
+	// Without brackets, such as "example.com" or "fe80::1%25eth0".
+	// The zone of IPv6 is escaped as "%25".
+	Hostname string
+
+	// Omitted if empty or "443".
+	Port string
+
+	// Escaped path, such as "/a%2Fb".
+	// If empty, it's "/".
+	EscapedPath string
+
+	RawQuery   string
+	ForceQuery bool
+}
+
+// NewHttpsURL returns the HTTPS URL of the request.
+//
+// The host is r.URL.Host for absolute-form request targets,
+// such as "GET http://example.com/ HTTP/1.1", otherwise it's r.Host.
+// The port of the host is kept.
+//
+// If the host is invalid, it returns [ErrInvalidHost].
+func NewHttpsURL(r *http.Request) (*HttpsURL, error) {
+	host := r.URL.Host
+	if host == "" {
+		host = r.Host
+	}
+	hostname, port, err := SplitHost(host)
+	if err != nil {
+		return nil, err
+	}
+	return &HttpsURL{
+		Hostname:    hostname,
+		Port:        port,
+		EscapedPath: r.URL.EscapedPath(),
+		RawQuery:    r.URL.RawQuery,
+		ForceQuery:  r.URL.ForceQuery,
+	}, nil
+}
+
+// SplitHost splits the host like "example.com:80", "[::1]:80", "[::1]"
+// or "[fe80::1%25eth0]" into the hostname without brackets and the port.
+// The port is empty if not found.
+//
+// If the host is empty or contains invalid characters,
+// such as "/", "@" or "\\", it returns [ErrInvalidHost].
+func SplitHost(host string) (hostname string, port string, err error) {
+	hostname = host
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		hostname, port = h, p
+	} else if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		hostname = host[1 : len(host)-1]
+	}
+	if !validHostname(hostname) || !validPort(port) {
+		return "", "", ErrInvalidHost
+	}
+	if i := strings.IndexByte(hostname, '%'); i != -1 && !strings.HasPrefix(hostname[i:], "%25") {
+		// Unescaped IPv6 zone
+		hostname = hostname[:i] + "%25" + hostname[i+1:]
+	}
+	return hostname, port, nil
+}
+
+func validHostname(h string) bool {
+	if h == "" {
+		return false
+	}
+	for i := 0; i < len(h); i++ {
+		c := h[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-', c == '.', c == '_':
+		case c == ':', c == '%':
+			// IPv6 and zone
+			if !strings.Contains(h, ":") {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func validPort(p string) bool {
+	for i := 0; i < len(p); i++ {
+		if p[i] < '0' || p[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Host returns the host with the port, such as "example.com:8443" or "[::1]".
+func (u *HttpsURL) Host() string {
+	host := u.Hostname
+	if strings.IndexByte(host, ':') != -1 {
+		// IPv6
+		host = "[" + host + "]"
+	}
+	if u.Port != "" && u.Port != "443" {
+		host += ":" + u.Port
+	}
+	return host
+}
+
+// String returns the URL.
+//
+// The path is kept as is, since the URL always has the host.
+// If the path does not start with "/", such as "@evil.com",
+// "/" is added so that it can not be a part of the host.
+func (u *HttpsURL) String() string {
+	path := u.EscapedPath
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	url := "https://" + u.Host() + path
+	if u.ForceQuery || u.RawQuery != "" {
+		url += "?" + u.RawQuery
+	}
+	return url
+}